@@ -1,19 +1,42 @@
 module github.com/cloudfoundry/ruby-buildpack
 
+go 1.27.1
+
 require (
 	github.com/Masterminds/semver v1.4.2
 	github.com/blang/semver v3.5.1+incompatible
 	github.com/cloudfoundry/libbuildpack v0.0.0-00010101000000-000000000000
 	// github.com/cloudfoundry/libbuildpack v0.0.0-20190528004455-15191cf91ae2
 	github.com/golang/mock v1.3.1
-	github.com/golang/protobuf v1.3.1 // indirect
 	github.com/kr/text v0.1.0
 	github.com/onsi/ginkgo v1.8.0
 	github.com/onsi/gomega v1.4.3
 	golang.org/x/crypto v0.0.0-20190424203555-c05e17bb3b2d
+)
+
+require (
+	github.com/BurntSushi/toml v0.3.1 // indirect
+	github.com/elazarl/goproxy v0.0.0-20181111060418-2ce16c963a8a // indirect
+	github.com/fsnotify/fsnotify v1.4.7 // indirect
+	github.com/golang/protobuf v1.3.1 // indirect
+	github.com/google/subcommands v0.0.0-20181012225330-46f0354f6315 // indirect
+	github.com/hpcloud/tail v1.0.0 // indirect
+	github.com/kr/pretty v0.1.0 // indirect
+	github.com/kr/pty v1.1.1 // indirect
+	github.com/pkg/errors v0.8.1 // indirect
+	github.com/termie/go-shutil v0.0.0-20140729215957-bcacb06fecae // indirect
+	github.com/tidwall/gjson v1.1.3 // indirect
+	github.com/tidwall/match v1.0.1 // indirect
 	golang.org/x/net v0.0.0-20190424112056-4829fb13d2c6 // indirect
+	golang.org/x/sync v0.0.0-20190423024810-112230192c58 // indirect
 	golang.org/x/sys v0.0.0-20190425145619-16072639606e // indirect
 	golang.org/x/text v0.3.1 // indirect
+	golang.org/x/tools v0.0.0-20190425150028-36563e24a262 // indirect
+	gopkg.in/check.v1 v1.0.0-20180628173108-788fd7840127 // indirect
+	gopkg.in/fsnotify.v1 v1.4.7 // indirect
+	gopkg.in/jarcoal/httpmock.v1 v1.0.0-20181117152235-275e9df93516 // indirect
+	gopkg.in/tomb.v1 v1.0.0-20141024135613-dd632973f1e7 // indirect
+	gopkg.in/yaml.v2 v2.2.2 // indirect
 )
 
 // replace github.com/cloudfoundry/libbuildpack => github.com/drnic/libbuildpack cutlass-skip-tls-verify
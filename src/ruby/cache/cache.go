@@ -5,13 +5,18 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strings"
 
 	"github.com/cloudfoundry/libbuildpack"
 )
 
 type Metadata struct {
-	Stack         string
-	SecretKeyBase string
+	Stack               string
+	SecretKeyBase       string
+	GemfileLockChecksum string
+	Ruby                string
+	YarnLockChecksum    string
+	NodeMajor           string
 }
 
 type Cache struct {
@@ -72,20 +77,33 @@ func (c *Cache) Restore() error {
 			}
 		}
 	} else if c.metadata.Stack != "" {
-		c.log.BeginStep("Skipping restoring vendor_bundle from cache, stack changed from %s to %s", c.metadata.Stack, os.Getenv("CF_STACK"))
+		c.log.BeginStep("Skipping restoring %s from cache, stack changed from %s to %s", strings.Join(c.names, " and "), c.metadata.Stack, os.Getenv("CF_STACK"))
 	}
-	return os.RemoveAll(filepath.Join(c.cacheDir, "vendor_bundle"))
+	for _, name := range c.names {
+		if err := os.RemoveAll(filepath.Join(c.cacheDir, name)); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
+// Save also removes what Restore left in the dep dir for names that are saved
+// from elsewhere, so an app that no longer uses them does not carry a stale
+// copy in its droplet.
 func (c *Cache) Save() error {
 	for _, name := range c.names {
-		if exists, err := libbuildpack.FileExists(filepath.Join(c.depDir, name)); err != nil {
+		if c.saveDir(name) != c.depDir {
+			if err := os.RemoveAll(filepath.Join(c.depDir, name)); err != nil {
+				return err
+			}
+		}
+		if exists, err := libbuildpack.FileExists(filepath.Join(c.saveDir(name), name)); err != nil {
 			return err
 		} else if exists {
 			c.log.BeginStep("Saving %s to cache", name)
-			cmd := exec.Command("cp", "-al", filepath.Join(c.depDir, name), filepath.Join(c.cacheDir, name))
+			cmd := exec.Command("cp", "-al", filepath.Join(c.saveDir(name), name), filepath.Join(c.cacheDir, name))
 			if output, err := cmd.CombinedOutput(); err != nil {
-				c.log.Error(string(output))
+				c.log.Error("%s", string(output))
 				return fmt.Errorf("Could not copy %s: %v", name, err)
 			}
 		}
@@ -99,6 +117,16 @@ func (c *Cache) Save() error {
 	return nil
 }
 
+// saveDir is where name is saved from. Both are restored into the dep dir,
+// but yarn installs node_modules into the app, so the supplier moves it to
+// the build dir once it has checked it still matches yarn.lock.
+func (c *Cache) saveDir(name string) string {
+	if name == "node_modules" {
+		return c.buildDir
+	}
+	return c.depDir
+}
+
 func (c *Cache) metadata_yml() string {
 	return filepath.Join(c.cacheDir, "metadata.yml")
 }
@@ -119,6 +119,23 @@ var _ = Describe("Cache", func() {
 			Expect(filepath.Join(cacheDir, "vendor_bundle", "adir", "bdir")).To(BeADirectory())
 		})
 
+		It("Copies node_modules from the build dir to cacheDir", func() {
+			Expect(os.MkdirAll(filepath.Join(buildDir, "node_modules", "left-pad"), 0755)).To(Succeed())
+			mockYaml.EXPECT().Write(filepath.Join(cacheDir, "metadata.yml"), gomock.Any()).Return(nil)
+			Expect(c.Save()).To(Succeed())
+
+			Expect(filepath.Join(cacheDir, "node_modules", "left-pad")).To(BeADirectory())
+		})
+
+		It("removes node_modules the app did not use from the dep dir", func() {
+			Expect(os.MkdirAll(filepath.Join(depsDir, depsIdx, "node_modules", "left-pad"), 0755)).To(Succeed())
+			mockYaml.EXPECT().Write(filepath.Join(cacheDir, "metadata.yml"), gomock.Any()).Return(nil)
+			Expect(c.Save()).To(Succeed())
+
+			Expect(filepath.Join(depsDir, depsIdx, "node_modules")).ToNot(BeADirectory())
+			Expect(filepath.Join(cacheDir, "node_modules")).ToNot(BeADirectory())
+		})
+
 		It("Stores metadata", func() {
 			mockYaml.EXPECT().Write(filepath.Join(cacheDir, "metadata.yml"), gomock.Any()).Return(nil)
 
@@ -130,6 +147,7 @@ var _ = Describe("Cache", func() {
 		var c *cache.Cache
 		BeforeEach(func() {
 			Expect(os.MkdirAll(filepath.Join(cacheDir, "vendor_bundle", "adir", "bdir"), 0755)).To(Succeed())
+			Expect(os.MkdirAll(filepath.Join(cacheDir, "node_modules", "left-pad"), 0755)).To(Succeed())
 			mockYaml.EXPECT().Load(filepath.Join(cacheDir, "metadata.yml"), gomock.Any()).Do(func(_ string, val interface{}) error {
 				metadata := val.(*cache.Metadata)
 				metadata.Stack = "cflinuxfs8"
@@ -162,6 +180,14 @@ var _ = Describe("Cache", func() {
 
 				Expect(filepath.Join(depsDir, depsIdx, "vendor_bundle")).ToNot(BeADirectory())
 				Expect(filepath.Join(cacheDir, "vendor_bundle")).ToNot(BeADirectory())
+				Expect(buffer.String()).To(ContainSubstring("Skipping restoring vendor_bundle and node_modules from cache, stack changed from cflinuxfs8 to cflinuxfs9"))
+			})
+
+			It("clears node_modules from the cache too", func() {
+				Expect(c.Restore()).To(Succeed())
+
+				Expect(filepath.Join(depsDir, depsIdx, "node_modules")).ToNot(BeADirectory())
+				Expect(filepath.Join(cacheDir, "node_modules")).ToNot(BeADirectory())
 			})
 		})
 	})
@@ -10,6 +10,7 @@ import (
 	"time"
 
 	"github.com/cloudfoundry/libbuildpack"
+	"github.com/cloudfoundry/ruby-buildpack/src/ruby/versions"
 	"github.com/kr/text"
 )
 
@@ -41,9 +42,12 @@ func Run(f *Finalizer) error {
 	if os.Getenv("BUNDLE_GEMFILE") != "" {
 		gemfileName = os.Getenv("BUNDLE_GEMFILE")
 	}
+	if rel, err := filepath.Rel(f.Stager.BuildDir(), gemfileName); filepath.IsAbs(gemfileName) && err == nil {
+		gemfileName = rel
+	}
 
 	if err := f.AssertGemfileLockExists(gemfileName); err != nil {
-		f.Log.Error(err.Error())
+		f.Log.Error("%s", err.Error())
 		return err
 	}
 
@@ -130,21 +134,21 @@ func (f *Finalizer) Setup() error {
 }
 
 func (f *Finalizer) AssertGemfileLockExists(gemfileName string) error {
-	if exists, err := libbuildpack.FileExists(filepath.Join(f.Stager.BuildDir(), fmt.Sprintf("%s.lock", gemfileName))); err != nil {
+	if exists, err := libbuildpack.FileExists(filepath.Join(f.Stager.BuildDir(), versions.GemfileLock(gemfileName))); err != nil {
 		return err
 	} else if !exists {
-		return errors.New(fmt.Sprintf("%s.lock required", gemfileName))
+		return errors.New(fmt.Sprintf("%s required", versions.GemfileLock(gemfileName)))
 	}
 	return nil
 }
 
 func (f *Finalizer) RestoreGemfileLock(gemfileName string) error {
-	source := filepath.Join(f.Stager.DepDir(), fmt.Sprintf("%s.lock", gemfileName))
+	source := filepath.Join(f.Stager.DepDir(), versions.GemfileLock(gemfileName))
 	f.Log.Debug("Restore GemfileLock; %s", source)
 	if exists, err := libbuildpack.FileExists(source); err != nil {
 		return err
 	} else if exists {
-		target := filepath.Join(f.Stager.BuildDir(), fmt.Sprintf("%s.lock", gemfileName))
+		target := filepath.Join(f.Stager.BuildDir(), versions.GemfileLock(gemfileName))
 		f.Log.Debug("RestoreGemfileLock; exists, copy to %s", target)
 		return os.Rename(source, target)
 	}
@@ -96,6 +96,15 @@ var _ = Describe("Finalize", func() {
 				Expect(finalizer.AssertGemfileLockExists("Gemfile")).To(MatchError("Gemfile.lock required"))
 			})
 		})
+		Context("the app uses gems.rb", func() {
+			It("Succeeds when gems.locked exists", func() {
+				Expect(ioutil.WriteFile(filepath.Join(buildDir, "gems.locked"), []byte("body"), 0644)).To(Succeed())
+				Expect(finalizer.AssertGemfileLockExists("gems.rb")).To(Succeed())
+			})
+			It("Fails when gems.locked is missing", func() {
+				Expect(finalizer.AssertGemfileLockExists("gems.rb")).To(MatchError("gems.locked required"))
+			})
+		})
 	})
 
 	Describe("RestoreBundleConfig", func() {
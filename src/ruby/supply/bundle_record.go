@@ -0,0 +1,68 @@
+package supply
+
+import (
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/cloudfoundry/libbuildpack"
+)
+
+// BundleInstallRecordFile is written to the dep dir, and so is in the
+// droplet, recording how bundle install was run so support can compare it
+// with how the app's gems were installed locally.
+const BundleInstallRecordFile = "bundle_install.yml"
+
+type BundleInstallRecord struct {
+	Command []string `yaml:"command"`
+	Env     []string `yaml:"env"`
+}
+
+var recordedEnvPrefixes = []string{"BUNDLE_", "GEM_", "RUBY", "NOKOGIRI_", "FREETDS_", "CF_STACK", "LANG", "PATH", "LD_LIBRARY_PATH", "LD_RUN_PATH", "LIBRARY_PATH", "CPATH"}
+
+var secretEnvName = regexp.MustCompile(`TOKEN|SECRET|PASSWORD|PASSWD|CREDENTIAL|_KEY`)
+
+var urlUserinfo = regexp.MustCompile(`://[^/@\s]+@`)
+
+// scrubEnv keeps the variables that affect how bundler resolves and builds
+// gems, redacting secrets: variables named like secrets, bundler host
+// credentials (BUNDLE_GEMS__EXAMPLE__COM=user:pass) and userinfo in URLs.
+func scrubEnv(env []string) []string {
+	var scrubbed []string
+	for _, entry := range env {
+		parts := strings.SplitN(entry, "=", 2)
+		name, value := parts[0], ""
+		if len(parts) == 2 {
+			value = parts[1]
+		}
+
+		relevant := false
+		for _, prefix := range recordedEnvPrefixes {
+			if strings.HasPrefix(name, prefix) {
+				relevant = true
+				break
+			}
+		}
+		if !relevant {
+			continue
+		}
+
+		if secretEnvName.MatchString(name) || (strings.HasPrefix(name, "BUNDLE_") && strings.Contains(name, "__")) {
+			value = "[REDACTED]"
+		} else {
+			value = urlUserinfo.ReplaceAllString(value, "://[REDACTED]@")
+		}
+		scrubbed = append(scrubbed, name+"="+value)
+	}
+	sort.Strings(scrubbed)
+	return scrubbed
+}
+
+func (s *Supplier) recordBundleInstall(args, env []string) error {
+	record := BundleInstallRecord{
+		Command: append([]string{"bundle"}, args...),
+		Env:     scrubEnv(env),
+	}
+	return libbuildpack.NewYAML().Write(filepath.Join(s.Stager.DepDir(), BundleInstallRecordFile), record)
+}
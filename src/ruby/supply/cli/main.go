@@ -65,15 +65,36 @@ func main() {
 		os.Exit(14)
 	}
 
+	formatted := supply.NewFormattedLogger(logger, os.Stdout, os.Getenv("BP_LOG_FORMAT"))
+	leveled := supply.NewLeveledLogger(formatted, os.Getenv("BP_LOG_LEVEL"))
+	// libbuildpack's logger only writes Debug messages when BP_DEBUG is set
+	if leveled.Level() == supply.LogLevelDebug && os.Getenv("BP_DEBUG") == "" {
+		os.Setenv("BP_DEBUG", "true")
+	}
+	log := supply.NewAdvisoryLogger(leveled)
+
+	overrideInstaller, err := supply.NewOverrideInstaller(installer, stager.BuildDir(), log)
+	if err != nil {
+		logger.Error("Unable to load %s: %s", supply.DependencyOverridesFile, err.Error())
+		os.Exit(20)
+	}
+
+	retryInstaller, err := supply.NewRetryInstaller(overrideInstaller, log)
+	if err != nil {
+		logger.Error("Unable to configure dependency install retries: %s", err.Error())
+		os.Exit(21)
+	}
+
 	s := supply.Supplier{
-		Stager:    stager,
-		Manifest:  manifest,
-		Installer: installer,
-		Log:       logger,
-		Versions:  versions.New(stager.BuildDir(), stager.DepDir(), manifest),
-		Cache:     cacher,
-		Command:   &libbuildpack.Command{},
-		TempDir:   &supply.LinuxTempDir{Log: logger},
+		Stager:          stager,
+		Manifest:        manifest,
+		Installer:       retryInstaller,
+		Log:             log,
+		Versions:        versions.New(stager.BuildDir(), stager.DepDir(), manifest),
+		Cache:           cacher,
+		Command:         &libbuildpack.Command{},
+		TempDir:         &supply.LinuxTempDir{Log: logger},
+		SupportedStacks: supply.ManifestStacks(manifest, "freetds"),
 	}
 
 	err = supply.Run(&s)
@@ -81,6 +102,10 @@ func main() {
 		os.Exit(15)
 	}
 
+	if os.Getenv("BP_DRY_RUN") == "true" {
+		return
+	}
+
 	if err := stager.WriteConfigYml(nil); err != nil {
 		logger.Error("Error writing config.yml: %s", err.Error())
 		os.Exit(16)
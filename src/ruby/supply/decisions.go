@@ -0,0 +1,34 @@
+package supply
+
+import "strconv"
+
+// The decisions supply makes are written as env files (<depdir>/env/NAME),
+// which libbuildpack exports to the buildpacks that run after this one,
+// including the finalize phase. A paired finalize buildpack can read them
+// instead of detecting ruby again:
+//
+//	RUBY_BUILDPACK_ENGINE          ruby, jruby or truffleruby
+//	RUBY_BUILDPACK_RUBY_VERSION    the version of the ruby dependency installed
+//	RUBY_BUILDPACK_BUNDLER_VERSION the bundler installed into <depdir>/bundler
+//	RUBY_BUILDPACK_NODE_INSTALLED  true when this buildpack installed node
+const (
+	EngineDecisionEnv         = "RUBY_BUILDPACK_ENGINE"
+	RubyVersionDecisionEnv    = "RUBY_BUILDPACK_RUBY_VERSION"
+	BundlerVersionDecisionEnv = "RUBY_BUILDPACK_BUNDLER_VERSION"
+	NodeInstalledDecisionEnv  = "RUBY_BUILDPACK_NODE_INSTALLED"
+)
+
+func (s *Supplier) WriteDecisions(engine, rubyVersion string) error {
+	decisions := map[string]string{
+		EngineDecisionEnv:         engine,
+		RubyVersionDecisionEnv:    rubyVersion,
+		BundlerVersionDecisionEnv: s.Versions.GetBundlerVersion(),
+		NodeInstalledDecisionEnv:  strconv.FormatBool(s.NeedsNode()),
+	}
+	for name, value := range decisions {
+		if err := s.Stager.WriteEnvFile(name, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,144 @@
+package supply
+
+import (
+	"errors"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/cloudfoundry/libbuildpack"
+)
+
+// errDryRun is returned for every command a dry run skips.
+var errDryRun = errors.New("not run in a dry run")
+
+func dryRun() bool {
+	return os.Getenv("BP_DRY_RUN") == "true"
+}
+
+// dryRunInstaller logs the dependencies it is asked for instead of
+// downloading them.
+type dryRunInstaller struct {
+	log Logger
+}
+
+func (d dryRunInstaller) InstallDependency(dep libbuildpack.Dependency, outputDir string) error {
+	d.log.Info("Would install %s %s", dep.Name, dep.Version)
+	return nil
+}
+
+func (d dryRunInstaller) InstallOnlyVersion(name string, installDir string) error {
+	d.log.Info("Would install %s", name)
+	return nil
+}
+
+func (d dryRunInstaller) FetchDependency(dep libbuildpack.Dependency, outputFile string) error {
+	d.log.Info("Would fetch %s %s", dep.Name, dep.Version)
+	return nil
+}
+
+// dryRunCommand logs the commands it is asked to run, at Debug, and fails
+// them with errDryRun. The output of the programs in resolvers, which only
+// print a version the plan depends on, is still taken from command.
+type dryRunCommand struct {
+	log       Logger
+	command   Command
+	resolvers []string
+}
+
+func (d dryRunCommand) Execute(dir string, stdout io.Writer, stderr io.Writer, program string, args ...string) error {
+	return d.skip(append([]string{program}, args...))
+}
+
+func (d dryRunCommand) Output(dir string, program string, args ...string) (string, error) {
+	for _, resolver := range d.resolvers {
+		if program == resolver {
+			return d.command.Output(dir, program, args...)
+		}
+	}
+	return "", d.skip(append([]string{program}, args...))
+}
+
+func (d dryRunCommand) Run(cmd *exec.Cmd) error {
+	return d.skip(cmd.Args)
+}
+
+func (d dryRunCommand) skip(args []string) error {
+	d.log.Debug("Would run %s", strings.Join(args, " "))
+	return errDryRun
+}
+
+// DryRun logs the plan Run would follow for the app when BP_DRY_RUN=true:
+// the FreeTDS, bundler and ruby versions it resolves and whether node is
+// needed. Nothing is downloaded, run or written, since the Installer and
+// Command are replaced first. Resolving the ruby from a Gemfile still needs
+// a ruby and bundler to evaluate it with, and bin/cf_ruby_version is still
+// run, since the version it prints is part of the plan.
+func (s *Supplier) DryRun() error {
+	s.Installer = dryRunInstaller{log: s.Log}
+	s.Command = dryRunCommand{log: s.Log, command: s.Command, resolvers: []string{s.rubyVersionScript()}}
+
+	s.Log.BeginStep("Dry run: planning the steps to supply, without installing anything")
+
+	freetds, err := s.FreeTDSDependency()
+	if err != nil {
+		s.Log.Error("Unable to determine FreeTDS version: %s", err.Error())
+		return err
+	}
+	s.Log.Info("Would install FreeTDS %s", freetds.Version)
+
+	if err := s.detectGemfile(); err != nil {
+		s.Log.Error("Error during setup: %v", err)
+		return err
+	}
+
+	bundler, err := s.plannedBundlerVersion()
+	if err != nil {
+		s.Log.Error("Unable to determine bundler version: %s", err.Error())
+		return err
+	}
+	s.Versions.SetBundlerVersion(bundler)
+	s.Log.Info("Would install bundler %s", bundler)
+
+	engine, version, err := s.DetermineRuby()
+	if err != nil {
+		s.Log.Error("Unable to determine ruby: %s", err.Error())
+		return err
+	}
+	s.Log.Info("Would install %s %s", engine, version)
+
+	if s.NeedsNode() {
+		version, err := s.nodeVersion()
+		if err != nil {
+			s.Log.Error("Unable to determine node version: %s", err.Error())
+			return err
+		}
+		s.Log.Info("Would install node %s", version)
+	} else {
+		s.Log.Info("Node is not needed")
+	}
+
+	return nil
+}
+
+// plannedBundlerVersion is the bundler InstallBundler would end up using,
+// leaving out a bundler vendored in the app.
+func (s *Supplier) plannedBundlerVersion() (string, error) {
+	bundlerOneVersion, err := s.bundlerVersion("1")
+	if err != nil || !s.appHasGemfile {
+		return bundlerOneVersion, err
+	}
+
+	if err := s.checkBundledWithAvailable(); err != nil {
+		return "", err
+	}
+
+	bundlerTwoVersion, err := s.resolveBundlerVersion()
+	if err != nil {
+		return "", err
+	} else if bundlerTwoVersion == "" {
+		return bundlerOneVersion, nil
+	}
+	return bundlerTwoVersion, nil
+}
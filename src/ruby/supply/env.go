@@ -0,0 +1,105 @@
+package supply
+
+import (
+	"os"
+	"sort"
+	"strings"
+)
+
+// requiredSubprocessEnv is always passed to bundler, even when
+// BP_SUBPROCESS_ENV_ALLOW does not list it, since staging relies on it.
+var requiredSubprocessEnv = []string{
+	"PATH",
+	"HOME",
+	"TMPDIR",
+	"LANG",
+	"DEPS_DIR",
+	"CF_STACK",
+	"LD_LIBRARY_PATH",
+	"LD_RUN_PATH",
+	"LIBRARY_PATH",
+	"CPATH",
+	"GEM_*",
+	"BUNDLE_*",
+}
+
+// subprocessEnv returns the environment for commands run while staging,
+// filtered by BP_SUBPROCESS_ENV_ALLOW and BP_SUBPROCESS_ENV_DENY. Both are
+// comma separated names, where a trailing * matches a prefix (e.g. AWS_*).
+// When neither is set the whole environment is passed through. The deny
+// list wins over the allow list and requiredSubprocessEnv.
+func subprocessEnv(extra ...string) []string {
+	allow := envPatterns(os.Getenv("BP_SUBPROCESS_ENV_ALLOW"))
+	deny := envPatterns(os.Getenv("BP_SUBPROCESS_ENV_DENY"))
+
+	var env []string
+	for _, entry := range append(os.Environ(), extra...) {
+		name := strings.SplitN(entry, "=", 2)[0]
+		if matchesEnvPattern(name, deny) {
+			continue
+		}
+		if len(allow) > 0 && !matchesEnvPattern(name, allow) && !matchesEnvPattern(name, requiredSubprocessEnv) {
+			continue
+		}
+		env = append(env, entry)
+	}
+	return env
+}
+
+func envPatterns(list string) []string {
+	var patterns []string
+	for _, pattern := range strings.Split(list, ",") {
+		if pattern = strings.TrimSpace(pattern); pattern != "" {
+			patterns = append(patterns, pattern)
+		}
+	}
+	return patterns
+}
+
+func matchesEnvPattern(name string, patterns []string) bool {
+	for _, pattern := range patterns {
+		if strings.HasSuffix(pattern, "*") {
+			if strings.HasPrefix(name, strings.TrimSuffix(pattern, "*")) {
+				return true
+			}
+		} else if name == pattern {
+			return true
+		}
+	}
+	return false
+}
+
+// bundlerSettingNamespaces are bundler settings whose variables contain __
+// like host credentials do, but which are not credentials.
+var bundlerSettingNamespaces = []string{"BUNDLE_BUILD__*", "BUNDLE_MIRROR__*", "BUNDLE_LOCAL__*"}
+
+// bundlerCredentials returns the credentials bundler reads from the
+// environment for private gem sources. They are named after the source's
+// host, with dots as __, e.g. BUNDLE_GEMS__EXAMPLE__COM=user:pass.
+func bundlerCredentials() []string {
+	var credentials []string
+	for _, entry := range os.Environ() {
+		name := strings.SplitN(entry, "=", 2)[0]
+		if !strings.HasPrefix(name, "BUNDLE_") || !strings.Contains(name, "__") || matchesEnvPattern(name, bundlerSettingNamespaces) {
+			continue
+		}
+		credentials = append(credentials, entry)
+	}
+	sort.Strings(credentials)
+	return credentials
+}
+
+// withEnv appends the entries of extra whose variables env does not set,
+// so that they are passed even when BP_SUBPROCESS_ENV_DENY filtered them out.
+func withEnv(env []string, extra ...string) []string {
+	set := map[string]bool{}
+	for _, entry := range env {
+		set[strings.SplitN(entry, "=", 2)[0]] = true
+	}
+	for _, entry := range extra {
+		if !set[strings.SplitN(entry, "=", 2)[0]] {
+			env = append(env, entry)
+		}
+	}
+	return env
+}
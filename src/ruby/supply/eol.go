@@ -0,0 +1,64 @@
+package supply
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/Masterminds/semver"
+)
+
+// rubyEndOfLife is when each MRI line stops getting security fixes, from
+// https://www.ruby-lang.org/en/downloads/branches/. Dates for lines that are
+// still maintained are the planned ones; add new lines as they are released.
+var rubyEndOfLife = map[string]string{
+	"1.9": "2015-02-23",
+	"2.0": "2016-02-24",
+	"2.1": "2017-03-31",
+	"2.2": "2018-03-31",
+	"2.3": "2019-03-31",
+	"2.4": "2020-03-31",
+	"2.5": "2021-03-31",
+	"2.6": "2022-04-12",
+	"2.7": "2023-03-31",
+	"3.0": "2024-04-23",
+	"3.1": "2025-03-26",
+	"3.2": "2026-03-31",
+	"3.3": "2027-03-31",
+	"3.4": "2028-03-31",
+}
+
+// rubyEndOfLifeNotice is how long before its end of life a ruby is warned about.
+const rubyEndOfLifeNotice = 180 * 24 * time.Hour
+
+// WarnRubyEndOfLife warns when the app's ruby has reached, or is within
+// rubyEndOfLifeNotice of, its end of life as of today. It only informs, so it
+// never fails staging. Only MRI is checked.
+func (s *Supplier) WarnRubyEndOfLife(engine, version string, today time.Time) {
+	if engine != "ruby" {
+		return
+	}
+	parsed, err := semver.NewVersion(version)
+	if err != nil {
+		s.Log.Debug("Not checking the end of life of ruby %s: %v", version, err)
+		return
+	}
+
+	line := fmt.Sprintf("%d.%d", parsed.Major(), parsed.Minor())
+	date, known := rubyEndOfLife[line]
+	if !known {
+		if parsed.LessThan(semver.MustParse("3.0.0")) {
+			s.Log.Warning("Ruby %s has reached end of life and no longer gets security fixes.\nUpgrade to a supported ruby, see https://www.ruby-lang.org/en/downloads/branches/", version)
+		}
+		return
+	}
+
+	endOfLife, err := time.Parse("2006-01-02", date)
+	if err != nil {
+		return
+	}
+	if !today.Before(endOfLife) {
+		s.Log.Warning("Ruby %s reached end of life on %s and no longer gets security fixes.\nUpgrade to a supported ruby, see https://www.ruby-lang.org/en/downloads/branches/", line, date)
+	} else if endOfLife.Sub(today) <= rubyEndOfLifeNotice {
+		s.Log.Warning("Ruby %s reaches end of life on %s, after which it gets no security fixes.\nPlan an upgrade to a newer ruby, see https://www.ruby-lang.org/en/downloads/branches/", line, date)
+	}
+}
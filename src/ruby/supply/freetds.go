@@ -0,0 +1,603 @@
+package supply
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/cloudfoundry/libbuildpack"
+)
+
+const freeTDSProfileD = `#!/bin/bash
+# https://github.com/rails-sqlserver/tiny_tds/blob/master/ext/tiny_tds/extconf.rb#L38
+%s
+
+# https://www.freetds.org/faq.html#SYBASE
+export SYBASE=$FREETDS_DIR
+
+# Puts tsql and osql on the PATH of cf ssh sessions and release scripts
+case ":${PATH}:" in
+  *":${FREETDS_DIR}/bin:"*) ;;
+  *) export PATH="${FREETDS_DIR}/bin:${PATH}" ;;
+esac
+
+`
+
+// freeTDSDirGlob finds the FreeTDS supplied by any buildpack at runtime. If
+// it matches zero or several dirs the app would otherwise silently fail to
+// connect, or connect through the wrong FreeTDS, so the script says so.
+const freeTDSDirGlob = `FREETDS_DIRS=( /home/vcap/deps/*/freetds )
+if [ ! -d "${FREETDS_DIRS[0]}" ]; then
+  echo "WARNING: FreeTDS not found in /home/vcap/deps/*/freetds" >&2
+elif [ "${#FREETDS_DIRS[@]}" -gt 1 ]; then
+  echo "WARNING: ${#FREETDS_DIRS[@]} buildpacks supplied FreeTDS (${FREETDS_DIRS[*]}), using ${FREETDS_DIRS[0]}" >&2
+fi
+export FREETDS_DIR="$( cd "${FREETDS_DIRS[0]}" && pwd )"`
+
+const defaultFreeTDSClientCharset = "UTF-8"
+
+const (
+	defaultFreeTDSDumpFile       = "/tmp/freetds.log"
+	defaultFreeTDSDumpConfigFile = "/tmp/freetds-conf.log"
+)
+
+// FreeTDSDependency returns the FreeTDS to install: the version pinned in the
+// app's .freetds-version (a version or constraint such as 1.1.x), or the
+// manifest's default when the app does not pin one.
+func (s *Supplier) FreeTDSDependency() (libbuildpack.Dependency, error) {
+	body, err := ioutil.ReadFile(filepath.Join(s.Stager.BuildDir(), ".freetds-version"))
+	if os.IsNotExist(err) {
+		return s.Manifest.DefaultVersion("freetds")
+	} else if err != nil {
+		return libbuildpack.Dependency{}, err
+	}
+
+	requested := strings.TrimSpace(string(body))
+	if requested == "" {
+		return s.Manifest.DefaultVersion("freetds")
+	}
+
+	versions := s.Manifest.AllDependencyVersions("freetds")
+	version, err := libbuildpack.FindMatchingVersion(requested, versions)
+	if err != nil {
+		return libbuildpack.Dependency{}, fmt.Errorf(".freetds-version asks for FreeTDS %s, which this buildpack does not provide (available: %s)", requested, strings.Join(versions, ", "))
+	}
+
+	s.Log.Info("Using FreeTDS %s from .freetds-version", version)
+	return libbuildpack.Dependency{Name: "freetds", Version: version}, nil
+}
+
+// tsqlSettings runs the installed tsql -C, which prints the settings FreeTDS
+// was compiled with (version, threadsafety, iconv, TLS library and so on).
+func (s *Supplier) tsqlSettings() (string, error) {
+	installDir := filepath.Join(s.Stager.DepDir(), "freetds")
+	tsql := filepath.Join(installDir, "bin", "tsql")
+	if info, err := os.Stat(tsql); os.IsNotExist(err) {
+		return "", fmt.Errorf("%s is missing", tsql)
+	} else if err != nil {
+		return "", err
+	} else if info.Mode()&0111 == 0 {
+		return "", fmt.Errorf("%s is not executable", tsql)
+	}
+
+	output, err := s.Command.Output(installDir, "bin/tsql", "-C")
+	if err != nil {
+		return "", fmt.Errorf("bin/tsql -C failed: %v", err)
+	}
+	return output, nil
+}
+
+// SmokeTestFreeTDS runs tsql -C when Debug logging is enabled, so a FreeTDS
+// that is missing a shared library fails staging rather than the app's first
+// connection.
+func (s *Supplier) SmokeTestFreeTDS() error {
+	if !DebugEnabled(s.Log) {
+		return nil
+	}
+
+	s.Log.BeginStep("Checking FreeTDS")
+	output, err := s.tsqlSettings()
+	if err != nil {
+		return fmt.Errorf("FreeTDS smoke test failed: %v", err)
+	}
+	for _, line := range strings.Split(strings.TrimRight(output, "\n"), "\n") {
+		s.Log.Info("%s", strings.TrimSpace(line))
+	}
+	return nil
+}
+
+// freeTDSSharedLibraries are the FreeTDS libraries apps load at runtime:
+// libsybdb.so through tiny_tds and libtdsodbc.so through unixODBC.
+var freeTDSSharedLibraries = []string{"libsybdb.so", "libtdsodbc.so"}
+
+var lddNotFound = regexp.MustCompile(`(?m)^\s*(\S+) => not found\s*$`)
+
+// CheckFreeTDSLibraries runs ldd against the installed FreeTDS shared
+// libraries, so a library the stack does not provide fails staging with its
+// name rather than crashing the app when it connects. It is skipped when ldd
+// is not available. Run it once the staging library paths are set, so the
+// libiconv this buildpack supplies is found.
+func (s *Supplier) CheckFreeTDSLibraries() error {
+	if _, err := exec.LookPath("ldd"); err != nil {
+		s.Log.Debug("Not checking the FreeTDS shared libraries, since ldd is not available")
+		return nil
+	}
+
+	libDir := filepath.Join(s.Stager.DepDir(), "freetds", "lib")
+	var missing []string
+	for _, name := range freeTDSSharedLibraries {
+		if exists, err := libbuildpack.FileExists(filepath.Join(libDir, name)); err != nil {
+			return err
+		} else if !exists {
+			continue
+		}
+
+		output, err := s.Command.Output(libDir, "ldd", name)
+		for _, match := range lddNotFound.FindAllStringSubmatch(output, -1) {
+			missing = append(missing, fmt.Sprintf("%s (needed by %s)", match[1], name))
+		}
+		if err != nil && len(missing) == 0 {
+			s.Log.Debug("ldd %s failed: %v", name, err)
+		}
+	}
+
+	if len(missing) > 0 {
+		return fmt.Errorf("The installed FreeTDS needs shared libraries the %s stack does not provide: %s\nInstall a FreeTDS built for this stack.", os.Getenv("CF_STACK"), strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+var tsqlTLSLibrary = regexp.MustCompile(`(?m)^\s*(OpenSSL|GnuTLS):\s*yes\s*$`)
+
+// CheckFreeTDSTLS warns when tsql -C shows FreeTDS was built without OpenSSL
+// or GnuTLS, since encrypted connections (required by Azure SQL) then fail.
+// It never fails staging, as local unencrypted connections still work.
+func (s *Supplier) CheckFreeTDSTLS() {
+	output, err := s.tsqlSettings()
+	if err != nil {
+		s.Log.Debug("Could not check FreeTDS for TLS support: %v", err)
+		return
+	}
+
+	if !tsqlTLSLibrary.MatchString(output) {
+		s.Log.Warning("The installed FreeTDS was not built with OpenSSL or GnuTLS.\nEncrypted connections, which Azure SQL requires, will fail.")
+	}
+}
+
+// CheckFreeTDSDirs checks at stage time that the FreeTDS glob used by
+// finalize_freetds.sh matches exactly the FreeTDS this buildpack installed.
+func (s *Supplier) CheckFreeTDSDirs() error {
+	if relocatableLayout() {
+		return nil
+	}
+
+	matches, err := filepath.Glob(filepath.Join(filepath.Dir(s.Stager.DepDir()), "*", "freetds"))
+	if err != nil {
+		return err
+	}
+
+	var dirs []string
+	for _, match := range matches {
+		if info, err := os.Stat(match); err == nil && info.IsDir() {
+			dirs = append(dirs, match)
+		}
+	}
+
+	switch len(dirs) {
+	case 0:
+		return fmt.Errorf("FreeTDS was not installed into %s", filepath.Join(s.Stager.DepDir(), "freetds"))
+	case 1:
+		return nil
+	default:
+		s.Log.Warning("More than one buildpack supplied FreeTDS: %s\nAt runtime FREETDS_DIR will be %s, which tiny_tds will use.\nRemove FreeTDS from the other buildpacks, or set BP_RELOCATABLE_LAYOUT=true to always use this buildpack's FreeTDS.", strings.Join(dirs, ", "), dirs[0])
+		return nil
+	}
+}
+
+// tdsVersions are the TDS protocol versions FreeTDS speaks, oldest first.
+var tdsVersions = []string{"5.0", "7.0", "7.1", "7.2", "7.3", "7.4"}
+
+func tdsVersionIndex(version string) int {
+	for i, v := range tdsVersions {
+		if v == version {
+			return i
+		}
+	}
+	return -1
+}
+
+// freeTDSConfSection is a [section] of freetds.conf.
+type freeTDSConfSection struct {
+	name     string
+	settings [][2]string
+}
+
+func renderFreeTDSConf(sections []freeTDSConfSection) string {
+	conf := "# Generated by the ruby-freetds buildpack\n"
+	for _, section := range sections {
+		conf += fmt.Sprintf("\n[%s]\n", section.name)
+		for _, setting := range section.settings {
+			conf += fmt.Sprintf("\t%s = %s\n", setting[0], setting[1])
+		}
+	}
+	return conf
+}
+
+func (s *Supplier) freeTDSConfPath() string {
+	return filepath.Join(s.Stager.DepDir(), "freetds", "freetds.conf")
+}
+
+// tdsVersionBounds reads FREETDS_MIN_TDS_VERSION and FREETDS_MAX_TDS_VERSION,
+// returning the global freetds.conf settings and the min. FreeTDS starts
+// negotiating at its configured tds version and falls back to older versions
+// the server accepts, so the max (or auto when unset) becomes the tds version.
+// FreeTDS has no setting for a floor, so the min is enforced by
+// checkMinTDSVersion instead.
+func tdsVersionBounds() ([][2]string, string, error) {
+	min := os.Getenv("FREETDS_MIN_TDS_VERSION")
+	max := os.Getenv("FREETDS_MAX_TDS_VERSION")
+	if min == "" && max == "" {
+		return nil, "", nil
+	}
+
+	for name, version := range map[string]string{"FREETDS_MIN_TDS_VERSION": min, "FREETDS_MAX_TDS_VERSION": max} {
+		if version != "" && tdsVersionIndex(version) < 0 {
+			return nil, "", fmt.Errorf("%s %s is not a TDS version, expected one of %s", name, version, strings.Join(tdsVersions, ", "))
+		}
+	}
+	if min != "" && max != "" && tdsVersionIndex(min) > tdsVersionIndex(max) {
+		return nil, "", fmt.Errorf("FREETDS_MIN_TDS_VERSION %s is newer than FREETDS_MAX_TDS_VERSION %s", min, max)
+	}
+
+	if max == "" {
+		return [][2]string{{"tds version", "auto"}}, min, nil
+	}
+	return [][2]string{{"tds version", max}}, min, nil
+}
+
+// checkMinTDSVersion fails staging when TDSVER or a tds_version in
+// freetds.yml pins a TDS version older than FREETDS_MIN_TDS_VERSION, since
+// FreeTDS would use it without negotiating up to the min. Versions that are
+// not TDS versions are reported where they are used.
+func checkMinTDSVersion(min string, config *FreeTDSConfig) error {
+	if min == "" {
+		return nil
+	}
+
+	pinned := [][2]string{{"TDSVER", os.Getenv("TDSVER")}}
+	if config != nil {
+		pinned = append(pinned, [2]string{FreeTDSConfigFile + " tds_version", config.TDSVersion})
+		for _, server := range config.Servers {
+			pinned = append(pinned, [2]string{fmt.Sprintf("%s server %s tds_version", FreeTDSConfigFile, server.Name), server.TDSVersion})
+		}
+	}
+	for _, version := range pinned {
+		if index := tdsVersionIndex(version[1]); index >= 0 && index < tdsVersionIndex(min) {
+			return fmt.Errorf("%s %s is older than FREETDS_MIN_TDS_VERSION %s", version[0], version[1], min)
+		}
+	}
+	return nil
+}
+
+// freeTDSTimeouts maps the env vars that tune FreeTDS's timeouts, in seconds,
+// to their freetds.conf settings.
+var freeTDSTimeouts = [][2]string{
+	{"FREETDS_TIMEOUT", "timeout"},
+	{"FREETDS_CONNECT_TIMEOUT", "connect timeout"},
+}
+
+// timeoutSettings returns the freetds.conf settings for the timeouts that are
+// set. Values that are not a positive number of seconds are warned about and
+// skipped, leaving FreeTDS's own default in place.
+func (s *Supplier) timeoutSettings() [][2]string {
+	var settings [][2]string
+	for _, timeout := range freeTDSTimeouts {
+		value := os.Getenv(timeout[0])
+		if value == "" {
+			continue
+		}
+		if seconds, err := strconv.Atoi(value); err != nil || seconds <= 0 {
+			s.Log.Warning("Ignoring %s %s, expected a positive number of seconds", timeout[0], value)
+			continue
+		}
+		settings = append(settings, [2]string{timeout[1], value})
+	}
+	return settings
+}
+
+const FreeTDSConfigFile = "freetds.yml"
+
+// FreeTDSServer is a named server in freetds.yml, which tiny_tds can connect
+// to with dataserver: <name>.
+type FreeTDSServer struct {
+	Name       string `yaml:"name"`
+	Host       string `yaml:"host"`
+	Port       int    `yaml:"port"`
+	TDSVersion string `yaml:"tds_version"`
+}
+
+type FreeTDSConfig struct {
+	TDSVersion string          `yaml:"tds_version"`
+	Servers    []FreeTDSServer `yaml:"servers"`
+}
+
+// loadFreeTDSConfig reads the app's freetds.yml, returning nil when there is
+// none.
+func (s *Supplier) loadFreeTDSConfig() (*FreeTDSConfig, error) {
+	source := filepath.Join(s.Stager.BuildDir(), FreeTDSConfigFile)
+	if exists, err := libbuildpack.FileExists(source); err != nil {
+		return nil, err
+	} else if !exists {
+		return nil, nil
+	}
+
+	config := &FreeTDSConfig{}
+	if err := libbuildpack.NewYAML().Load(source, config); err != nil {
+		return nil, fmt.Errorf("could not parse %s: %v", FreeTDSConfigFile, err)
+	}
+
+	for i, server := range config.Servers {
+		if server.Name == "" {
+			return nil, fmt.Errorf("%s: server %d needs a name", FreeTDSConfigFile, i+1)
+		}
+		if server.Host == "" || server.Port == 0 {
+			return nil, fmt.Errorf("%s: server %s needs a host and a port", FreeTDSConfigFile, server.Name)
+		}
+		if server.TDSVersion != "" && tdsVersionIndex(server.TDSVersion) < 0 {
+			return nil, fmt.Errorf("%s: server %s has tds_version %s, expected one of %s", FreeTDSConfigFile, server.Name, server.TDSVersion, strings.Join(tdsVersions, ", "))
+		}
+	}
+	return config, nil
+}
+
+func (server FreeTDSServer) confSection() freeTDSConfSection {
+	settings := [][2]string{
+		{"host", server.Host},
+		{"port", strconv.Itoa(server.Port)},
+	}
+	if server.TDSVersion != "" {
+		settings = append(settings, [2]string{"tds version", server.TDSVersion})
+	}
+	return freeTDSConfSection{name: server.Name, settings: settings}
+}
+
+// AppFreeTDSConfFile is a freetds.conf maintained by the app, which is used
+// as is in place of a generated one.
+const AppFreeTDSConfFile = "config/freetds.conf"
+
+// WriteFreeTDSConf puts a freetds.conf in the FreeTDS install dir: the app's
+// own config/freetds.conf when it has one, or else one rendered from the TDS
+// version bounds, FREETDS_CLIENT_CHARSET (UTF-8 by default), the timeouts and
+// the servers in freetds.yml. WriteFreeTDSProfileD points FREETDSCONF at it.
+func (s *Supplier) WriteFreeTDSConf() error {
+	global, minTDSVersion, err := tdsVersionBounds()
+	if err != nil {
+		return err
+	}
+	config, err := s.loadFreeTDSConfig()
+	if err != nil {
+		return err
+	}
+	if err := checkMinTDSVersion(minTDSVersion, config); err != nil {
+		return err
+	}
+
+	charset := os.Getenv("FREETDS_CLIENT_CHARSET")
+	timeouts := s.timeoutSettings()
+
+	if appConf, err := ioutil.ReadFile(filepath.Join(s.Stager.BuildDir(), AppFreeTDSConfFile)); err == nil {
+		if len(bytes.TrimSpace(appConf)) == 0 {
+			return fmt.Errorf("%s is empty", AppFreeTDSConfFile)
+		}
+		if len(global) > 0 || config != nil || charset != "" {
+			s.Log.Warning("Using %s as is, so the TDS version bounds, client charset and %s servers are not applied", AppFreeTDSConfFile, FreeTDSConfigFile)
+		}
+		if len(timeouts) > 0 {
+			s.Log.Warning("Using %s as is, so FREETDS_TIMEOUT and FREETDS_CONNECT_TIMEOUT are not applied", AppFreeTDSConfFile)
+		}
+		s.Log.Info("Using freetds.conf from %s", AppFreeTDSConfFile)
+		if err := os.MkdirAll(filepath.Dir(s.freeTDSConfPath()), 0755); err != nil {
+			return err
+		}
+		return ioutil.WriteFile(s.freeTDSConfPath(), appConf, 0644)
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	// Without a client charset FreeTDS converts to the server's charset,
+	// which garbles multibyte data, so UTF-8 is always set by default.
+	if charset == "" {
+		charset = defaultFreeTDSClientCharset
+	}
+	global = append(global, [2]string{"client charset", charset})
+	global = append(global, timeouts...)
+
+	s.Log.Info("Writing freetds.conf generated from the app's FreeTDS settings")
+	sections := []freeTDSConfSection{{name: "global", settings: global}}
+	if config != nil {
+		for _, server := range config.Servers {
+			sections = append(sections, server.confSection())
+		}
+	}
+	if err := os.MkdirAll(filepath.Dir(s.freeTDSConfPath()), 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(s.freeTDSConfPath(), []byte(renderFreeTDSConf(sections)), 0644)
+}
+
+func libiconvEnabled() bool {
+	return os.Getenv("BP_INSTALL_LIBICONV") == "true"
+}
+
+// InstallLibiconv installs the manifest's libiconv for stacks whose iconv
+// breaks FreeTDS charset conversion. Its lib dir is put ahead of the stack's
+// (see suppliedLibs).
+func (s *Supplier) InstallLibiconv() error {
+	if !libiconvEnabled() {
+		return nil
+	}
+
+	s.Log.BeginStep("Supplying libiconv")
+
+	installDir := filepath.Join(s.Stager.DepDir(), "libiconv")
+	return s.Installer.InstallOnlyVersion("libiconv", installDir)
+}
+
+var libPathVars = []string{"LD_LIBRARY_PATH", "LD_RUN_PATH", "LIBRARY_PATH"}
+
+type suppliedLib struct {
+	name       string
+	stagingDir string
+	runtimeDir string
+}
+
+// suppliedLibs returns the lib dirs of the libraries this buildpack supplies,
+// in the order they should appear on the library paths. The default order is
+// libiconv then freetds; BP_LIB_PATH_ORDER (e.g. "freetds,libiconv") moves the
+// named libraries to the front. Every library path is composed from this one
+// list so which lib wins does not depend on the order profile.d scripts run in.
+func (s *Supplier) suppliedLibs() ([]suppliedLib, error) {
+	var libs []suppliedLib
+	if libiconvEnabled() {
+		libs = append(libs, suppliedLib{"libiconv", filepath.Join(s.Stager.DepDir(), "libiconv", "lib"), s.runtimeDepDir() + "/libiconv/lib"})
+	}
+	libs = append(libs, suppliedLib{"freetds", filepath.Join(s.Stager.DepDir(), "freetds", "lib"), "${FREETDS_DIR}/lib"})
+
+	order := os.Getenv("BP_LIB_PATH_ORDER")
+	if order == "" {
+		return libs, nil
+	}
+
+	var ordered []suppliedLib
+	for _, name := range strings.Split(order, ",") {
+		name = strings.TrimSpace(name)
+		found := false
+		for i, lib := range libs {
+			if lib.name == name {
+				ordered = append(ordered, lib)
+				libs = append(libs[:i], libs[i+1:]...)
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("BP_LIB_PATH_ORDER names %s, which is not a supplied library", name)
+		}
+	}
+	return append(ordered, libs...), nil
+}
+
+func libPathExports(libs []suppliedLib) string {
+	dirs := make([]string, len(libs))
+	for i, lib := range libs {
+		dirs[i] = lib.runtimeDir
+	}
+
+	exports := "\n# https://github.com/rails-sqlserver/heroku-buildpack-freetds/blob/master/bin/compile#L90\n"
+	for _, name := range libPathVars {
+		exports += fmt.Sprintf("export %s=\"%s:${%s:-/usr/local/lib}\"\n", name, strings.Join(dirs, ":"), name)
+	}
+	return exports
+}
+
+// SetStagingLibPaths puts the supplied libs on the library paths of the
+// current process, so gems compiled by bundle install link against them.
+func (s *Supplier) SetStagingLibPaths() error {
+	libs, err := s.suppliedLibs()
+	if err != nil {
+		return err
+	}
+
+	for _, name := range libPathVars {
+		value := os.Getenv(name)
+		for i := len(libs) - 1; i >= 0; i-- {
+			if value == "" {
+				value = libs[i].stagingDir
+			} else {
+				value = libs[i].stagingDir + ":" + value
+			}
+		}
+		if err := os.Setenv(name, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// tdsVersion returns the TDS version to export as TDSVER, from TDSVER at
+// staging or else tds_version in freetds.yml. An invalid version is warned
+// about and not exported, since FreeTDS would fail every connection with it.
+func (s *Supplier) tdsVersion() (string, error) {
+	version, source := os.Getenv("TDSVER"), "TDSVER"
+	if version == "" {
+		config, err := s.loadFreeTDSConfig()
+		if err != nil {
+			return "", err
+		}
+		if config == nil {
+			return "", nil
+		}
+		version, source = config.TDSVersion, FreeTDSConfigFile
+	}
+
+	if version != "" && tdsVersionIndex(version) < 0 {
+		s.Log.Warning("Ignoring TDS version %s from %s, expected one of %s", version, source, strings.Join(tdsVersions, ", "))
+		return "", nil
+	}
+	return version, nil
+}
+
+// WriteFreeTDSProfileD writes the profile.d script that points tiny_tds at
+// the supplied FreeTDS. Packet and config dumping are opt-in via
+// FREETDS_DEBUG, with the packet dump file configurable through
+// FREETDS_DUMP_FILE.
+func (s *Supplier) WriteFreeTDSProfileD() error {
+	libs, err := s.suppliedLibs()
+	if err != nil {
+		return err
+	}
+	freeTDSDir := freeTDSDirGlob
+	if relocatableLayout() {
+		freeTDSDir = `export FREETDS_DIR="$( cd "${RUBY_BUILDPACK_DEP_DIR}/freetds" && pwd )"`
+	}
+	scriptContents := fmt.Sprintf(freeTDSProfileD, freeTDSDir) + libPathExports(libs)
+
+	if exists, err := libbuildpack.FileExists(s.freeTDSConfPath()); err != nil {
+		return err
+	} else if exists {
+		scriptContents += `
+# http://www.freetds.org/userguide/freetdsconf.htm
+export FREETDSCONF="${FREETDS_DIR}/freetds.conf"
+`
+	}
+
+	if tdsVersion, err := s.tdsVersion(); err != nil {
+		return err
+	} else if tdsVersion != "" {
+		scriptContents += fmt.Sprintf(`
+# http://www.freetds.org/userguide/envvar.htm
+export TDSVER=${TDSVER:-%s}
+`, tdsVersion)
+	}
+
+	if os.Getenv("FREETDS_DEBUG") == "true" {
+		dumpFile := os.Getenv("FREETDS_DUMP_FILE")
+		if dumpFile == "" {
+			dumpFile = defaultFreeTDSDumpFile
+		}
+		s.Log.Warning("FREETDS_DEBUG is enabled, FreeTDS will log every packet to %s\nThis file grows without bound and can fill the container's disk.\nSet FREETDS_DUMP_FILE to a path on a mounted volume, and unset FREETDS_DEBUG once you are done debugging.", dumpFile)
+		scriptContents += fmt.Sprintf(`
+# http://www.freetds.org/userguide/logging.htm
+export TDSDUMP=${TDSDUMP:-%s}
+export TDSDUMPCONFIG=${TDSDUMPCONFIG:-%s}
+`, dumpFile, defaultFreeTDSDumpConfigFile)
+	}
+
+	return s.writeRuntimeProfileD("finalize_freetds.sh", scriptContents)
+}
@@ -0,0 +1,40 @@
+package supply
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// relocatableDepDir is put at the top of every profile.d script that refers
+// to the dep dir when BP_RELOCATABLE_LAYOUT=true. It derives the dep dir from
+// where the script itself was sourced, so the droplet does not depend on the
+// deps index or path it was staged with.
+const relocatableDepDir = `RUBY_BUILDPACK_DEP_DIR="$( cd "$( dirname "${BASH_SOURCE[0]}" )/.." && pwd )"
+`
+
+func relocatableLayout() bool {
+	return os.Getenv("BP_RELOCATABLE_LAYOUT") == "true"
+}
+
+// runtimeDepDir is how profile.d scripts refer to this buildpack's dep dir.
+func (s *Supplier) runtimeDepDir() string {
+	if relocatableLayout() {
+		return "${RUBY_BUILDPACK_DEP_DIR}"
+	}
+	return fmt.Sprintf("$DEPS_DIR/%s", s.Stager.DepsIdx())
+}
+
+// writeRuntimeProfileD writes a profile.d script that uses runtimeDepDir,
+// defining RUBY_BUILDPACK_DEP_DIR first (after any shebang) when relocatable.
+func (s *Supplier) writeRuntimeProfileD(scriptName, scriptContents string) error {
+	if relocatableLayout() {
+		if strings.HasPrefix(scriptContents, "#!") {
+			lines := strings.SplitN(scriptContents, "\n", 2)
+			scriptContents = lines[0] + "\n" + relocatableDepDir + lines[1]
+		} else {
+			scriptContents = relocatableDepDir + scriptContents
+		}
+	}
+	return s.Stager.WriteProfileD(scriptName, scriptContents)
+}
@@ -0,0 +1,232 @@
+package supply
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/cloudfoundry/libbuildpack"
+)
+
+type Logger interface {
+	BeginStep(format string, args ...interface{})
+	Info(format string, args ...interface{})
+	Warning(format string, args ...interface{})
+	Error(format string, args ...interface{})
+	Debug(format string, args ...interface{})
+}
+
+// DebugEnabled reports whether log prints Debug messages, so work done only
+// to be logged at Debug can be skipped. Loggers that do not say are assumed
+// to be libbuildpack's, which prints them only when BP_DEBUG is set.
+func DebugEnabled(log Logger) bool {
+	if l, ok := log.(interface{ DebugEnabled() bool }); ok {
+		return l.DebugEnabled()
+	}
+	return os.Getenv("BP_DEBUG") != ""
+}
+
+type LogLevel int
+
+const (
+	LogLevelError LogLevel = iota
+	LogLevelWarn
+	LogLevelInfo
+	LogLevelDebug
+)
+
+var logLevels = map[string]LogLevel{
+	"error": LogLevelError,
+	"warn":  LogLevelWarn,
+	"info":  LogLevelInfo,
+	"debug": LogLevelDebug,
+}
+
+// LeveledLogger drops messages below its level before handing them to the
+// wrapped logger. BeginStep is treated as info.
+type LeveledLogger struct {
+	log   Logger
+	level LogLevel
+}
+
+// NewLeveledLogger parses a BP_LOG_LEVEL value. An empty value keeps the
+// historical behaviour (info, or debug when BP_DEBUG is set); an unknown
+// value is reported and treated as info. Only messages logged through it are
+// filtered: libbuildpack's installer, stager and cache take a
+// *libbuildpack.Logger and log to it directly.
+func NewLeveledLogger(log Logger, level string) *LeveledLogger {
+	l := &LeveledLogger{log: log, level: LogLevelInfo}
+
+	if level == "" {
+		if os.Getenv("BP_DEBUG") != "" {
+			l.level = LogLevelDebug
+		}
+		return l
+	}
+
+	if parsed, ok := logLevels[strings.ToLower(level)]; ok {
+		l.level = parsed
+	} else {
+		log.Warning("Unknown BP_LOG_LEVEL %s, expected one of error, warn, info or debug", level)
+	}
+
+	return l
+}
+
+func (l *LeveledLogger) Level() LogLevel {
+	return l.level
+}
+
+// DebugEnabled reports whether Debug messages are printed.
+func (l *LeveledLogger) DebugEnabled() bool {
+	return l.level >= LogLevelDebug
+}
+
+func (l *LeveledLogger) BeginStep(format string, args ...interface{}) {
+	if l.level >= LogLevelInfo {
+		l.log.BeginStep(format, args...)
+	}
+}
+
+func (l *LeveledLogger) Info(format string, args ...interface{}) {
+	if l.level >= LogLevelInfo {
+		l.log.Info(format, args...)
+	}
+}
+
+func (l *LeveledLogger) Warning(format string, args ...interface{}) {
+	if l.level >= LogLevelWarn {
+		l.log.Warning(format, args...)
+	}
+}
+
+func (l *LeveledLogger) Error(format string, args ...interface{}) {
+	l.log.Error(format, args...)
+}
+
+func (l *LeveledLogger) Debug(format string, args ...interface{}) {
+	if l.level >= LogLevelDebug {
+		l.log.Debug(format, args...)
+	}
+}
+
+// NewFormattedLogger returns a logger for a BP_LOG_FORMAT value: log itself
+// for the default text format, or a JSONLogger writing to w for json. An
+// unknown value is reported and treated as text.
+func NewFormattedLogger(log *libbuildpack.Logger, w io.Writer, format string) Logger {
+	switch strings.ToLower(format) {
+	case "", "text":
+		return log
+	case "json":
+		return NewJSONLogger(w)
+	}
+	log.Warning("Unknown BP_LOG_FORMAT %s, expected text or json", format)
+	return log
+}
+
+// JSONLogger writes every message as a JSON object on its own line, with the
+// time, the level, the step it was logged in and the message, for log
+// pipelines. BeginStep starts a step and is logged at info. Like
+// libbuildpack's logger, it only writes Debug messages when BP_DEBUG is set.
+type JSONLogger struct {
+	w    io.Writer
+	step string
+}
+
+type jsonLogLine struct {
+	Timestamp string `json:"timestamp"`
+	Level     string `json:"level"`
+	Step      string `json:"step,omitempty"`
+	Message   string `json:"message"`
+}
+
+func NewJSONLogger(w io.Writer) *JSONLogger {
+	return &JSONLogger{w: w}
+}
+
+func (j *JSONLogger) BeginStep(format string, args ...interface{}) {
+	j.step = fmt.Sprintf(format, args...)
+	j.write("info", j.step)
+}
+
+func (j *JSONLogger) Info(format string, args ...interface{}) {
+	j.write("info", fmt.Sprintf(format, args...))
+}
+
+func (j *JSONLogger) Warning(format string, args ...interface{}) {
+	j.write("warn", fmt.Sprintf(format, args...))
+}
+
+func (j *JSONLogger) Error(format string, args ...interface{}) {
+	j.write("error", fmt.Sprintf(format, args...))
+}
+
+func (j *JSONLogger) Debug(format string, args ...interface{}) {
+	if os.Getenv("BP_DEBUG") != "" {
+		j.write("debug", fmt.Sprintf(format, args...))
+	}
+}
+
+func (j *JSONLogger) write(level, message string) {
+	line, err := json.Marshal(jsonLogLine{
+		Timestamp: time.Now().UTC().Format(time.RFC3339Nano),
+		Level:     level,
+		Step:      j.step,
+		Message:   message,
+	})
+	if err != nil {
+		return
+	}
+	_, _ = j.w.Write(append(line, '\n'))
+}
+
+// AdvisoryLogger collects every warning logged during staging so Run can
+// repeat them in one report at the end, where users are likely to see them.
+// Warnings libbuildpack logs itself (e.g. end of life notices) bypass it.
+type AdvisoryLogger struct {
+	Logger
+	advisories []string
+}
+
+func NewAdvisoryLogger(log Logger) *AdvisoryLogger {
+	return &AdvisoryLogger{Logger: log}
+}
+
+func (a *AdvisoryLogger) Warning(format string, args ...interface{}) {
+	a.advisories = append(a.advisories, fmt.Sprintf(format, args...))
+	a.Logger.Warning(format, args...)
+}
+
+func (a *AdvisoryLogger) DebugEnabled() bool {
+	return DebugEnabled(a.Logger)
+}
+
+func (a *AdvisoryLogger) Advisories() []string {
+	return a.advisories
+}
+
+// ReportAdvisories logs the first line of each distinct warning, in the order
+// they were first logged. BP_ADVISORY_REPORT=false turns the report off.
+func (a *AdvisoryLogger) ReportAdvisories() {
+	if len(a.advisories) == 0 || os.Getenv("BP_ADVISORY_REPORT") == "false" {
+		return
+	}
+
+	var summaries []string
+	seen := map[string]bool{}
+	for _, advisory := range a.advisories {
+		summary := strings.SplitN(advisory, "\n", 2)[0]
+		if !seen[summary] {
+			seen[summary] = true
+			summaries = append(summaries, summary)
+		}
+	}
+
+	a.Logger.BeginStep("Advisories (%d)", len(summaries))
+	for i, summary := range summaries {
+		a.Logger.Info("%d. %s", i+1, summary)
+	}
+}
@@ -0,0 +1,278 @@
+package supply_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/cloudfoundry/ruby-buildpack/src/ruby/supply"
+
+	"github.com/cloudfoundry/libbuildpack"
+	"github.com/cloudfoundry/libbuildpack/ansicleaner"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("LeveledLogger", func() {
+	var (
+		buffer   *bytes.Buffer
+		logger   *libbuildpack.Logger
+		oldDebug string
+	)
+
+	BeforeEach(func() {
+		buffer = new(bytes.Buffer)
+		logger = libbuildpack.NewLogger(ansicleaner.New(buffer))
+		oldDebug = os.Getenv("BP_DEBUG")
+		os.Unsetenv("BP_DEBUG")
+	})
+
+	AfterEach(func() {
+		os.Setenv("BP_DEBUG", oldDebug)
+	})
+
+	logEverything := func(l supply.Logger) {
+		l.BeginStep("a step")
+		l.Info("some info")
+		l.Warning("a warning")
+		l.Error("an error")
+		l.Debug("some debug")
+	}
+
+	Context("level is error", func() {
+		It("only emits errors", func() {
+			logEverything(supply.NewLeveledLogger(logger, "error"))
+			Expect(buffer.String()).To(ContainSubstring("an error"))
+			Expect(buffer.String()).ToNot(ContainSubstring("a warning"))
+			Expect(buffer.String()).ToNot(ContainSubstring("some info"))
+			Expect(buffer.String()).ToNot(ContainSubstring("a step"))
+			Expect(buffer.String()).ToNot(ContainSubstring("some debug"))
+		})
+	})
+
+	Context("level is warn", func() {
+		It("emits warnings and errors", func() {
+			logEverything(supply.NewLeveledLogger(logger, "warn"))
+			Expect(buffer.String()).To(ContainSubstring("an error"))
+			Expect(buffer.String()).To(ContainSubstring("a warning"))
+			Expect(buffer.String()).ToNot(ContainSubstring("some info"))
+			Expect(buffer.String()).ToNot(ContainSubstring("a step"))
+		})
+	})
+
+	Context("level is info", func() {
+		It("emits everything but debug", func() {
+			logEverything(supply.NewLeveledLogger(logger, "INFO"))
+			Expect(buffer.String()).To(ContainSubstring("a step"))
+			Expect(buffer.String()).To(ContainSubstring("some info"))
+			Expect(buffer.String()).To(ContainSubstring("a warning"))
+			Expect(buffer.String()).ToNot(ContainSubstring("some debug"))
+		})
+	})
+
+	Context("level is debug", func() {
+		It("emits debug output", func() {
+			os.Setenv("BP_DEBUG", "1")
+			logEverything(supply.NewLeveledLogger(logger, "debug"))
+			Expect(buffer.String()).To(ContainSubstring("some info"))
+			Expect(buffer.String()).To(ContainSubstring("some debug"))
+		})
+
+		It("does not set BP_DEBUG for the rest of the process", func() {
+			supply.NewLeveledLogger(logger, "debug")
+			Expect(os.Getenv("BP_DEBUG")).To(BeEmpty())
+		})
+	})
+
+	Context("level is not set", func() {
+		It("defaults to info", func() {
+			l := supply.NewLeveledLogger(logger, "")
+			Expect(l.Level()).To(Equal(supply.LogLevelInfo))
+		})
+
+		It("defaults to debug when BP_DEBUG is set", func() {
+			os.Setenv("BP_DEBUG", "1")
+			l := supply.NewLeveledLogger(logger, "")
+			Expect(l.Level()).To(Equal(supply.LogLevelDebug))
+		})
+	})
+
+	Context("DebugEnabled", func() {
+		It("is true at the debug level", func() {
+			Expect(supply.DebugEnabled(supply.NewLeveledLogger(logger, "debug"))).To(BeTrue())
+		})
+
+		It("is false at the info level, even when BP_DEBUG is set", func() {
+			os.Setenv("BP_DEBUG", "1")
+			Expect(supply.DebugEnabled(supply.NewLeveledLogger(logger, "info"))).To(BeFalse())
+		})
+
+		It("is answered by the wrapped logger of an AdvisoryLogger", func() {
+			Expect(supply.DebugEnabled(supply.NewAdvisoryLogger(supply.NewLeveledLogger(logger, "debug")))).To(BeTrue())
+			Expect(supply.DebugEnabled(supply.NewAdvisoryLogger(supply.NewLeveledLogger(logger, "warn")))).To(BeFalse())
+		})
+
+		It("follows BP_DEBUG for libbuildpack's logger", func() {
+			Expect(supply.DebugEnabled(logger)).To(BeFalse())
+			os.Setenv("BP_DEBUG", "1")
+			Expect(supply.DebugEnabled(logger)).To(BeTrue())
+		})
+	})
+
+	Context("level is unknown", func() {
+		It("warns and defaults to info", func() {
+			l := supply.NewLeveledLogger(logger, "loud")
+			Expect(l.Level()).To(Equal(supply.LogLevelInfo))
+			Expect(buffer.String()).To(ContainSubstring("Unknown BP_LOG_LEVEL loud"))
+		})
+	})
+})
+
+var _ = Describe("NewFormattedLogger", func() {
+	var (
+		buffer *bytes.Buffer
+		logger *libbuildpack.Logger
+	)
+
+	BeforeEach(func() {
+		buffer = new(bytes.Buffer)
+		logger = libbuildpack.NewLogger(ansicleaner.New(buffer))
+	})
+
+	It("keeps the text logger by default, so its output is unchanged", func() {
+		Expect(supply.NewFormattedLogger(logger, buffer, "")).To(BeIdenticalTo(logger))
+		Expect(supply.NewFormattedLogger(logger, buffer, "text")).To(BeIdenticalTo(logger))
+
+		supply.NewFormattedLogger(logger, buffer, "").BeginStep("Installing %s", "ruby")
+		Expect(buffer.String()).To(Equal("-----> Installing ruby\n"))
+	})
+
+	It("returns a JSONLogger for json", func() {
+		Expect(supply.NewFormattedLogger(logger, buffer, "JSON")).To(BeAssignableToTypeOf(&supply.JSONLogger{}))
+	})
+
+	It("warns about an unknown format and keeps the text logger", func() {
+		Expect(supply.NewFormattedLogger(logger, buffer, "xml")).To(BeIdenticalTo(logger))
+		Expect(buffer.String()).To(ContainSubstring("Unknown BP_LOG_FORMAT xml"))
+	})
+})
+
+var _ = Describe("JSONLogger", func() {
+	var (
+		buffer   *bytes.Buffer
+		logger   *supply.JSONLogger
+		oldDebug string
+	)
+
+	type logLine struct {
+		Timestamp string `json:"timestamp"`
+		Level     string `json:"level"`
+		Step      string `json:"step"`
+		Message   string `json:"message"`
+	}
+
+	lines := func() []logLine {
+		var parsed []logLine
+		for _, line := range strings.Split(strings.TrimSpace(buffer.String()), "\n") {
+			var l logLine
+			Expect(json.Unmarshal([]byte(line), &l)).To(Succeed())
+			parsed = append(parsed, l)
+		}
+		return parsed
+	}
+
+	BeforeEach(func() {
+		buffer = new(bytes.Buffer)
+		logger = supply.NewJSONLogger(buffer)
+		oldDebug = os.Getenv("BP_DEBUG")
+		os.Unsetenv("BP_DEBUG")
+	})
+
+	AfterEach(func() {
+		os.Setenv("BP_DEBUG", oldDebug)
+	})
+
+	It("writes one JSON object per message, tagged with the current step", func() {
+		logger.BeginStep("Installing %s", "ruby")
+		logger.Warning("ruby %s is deprecated\nUpgrade soon", "2.5")
+
+		parsed := lines()
+		Expect(parsed).To(HaveLen(2))
+		Expect(parsed[0].Level).To(Equal("info"))
+		Expect(parsed[0].Step).To(Equal("Installing ruby"))
+		Expect(parsed[0].Message).To(Equal("Installing ruby"))
+		Expect(parsed[1].Level).To(Equal("warn"))
+		Expect(parsed[1].Step).To(Equal("Installing ruby"))
+		Expect(parsed[1].Message).To(Equal("ruby 2.5 is deprecated\nUpgrade soon"))
+
+		_, err := time.Parse(time.RFC3339Nano, parsed[1].Timestamp)
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	It("omits the step before the first one begins", func() {
+		logger.Info("some info")
+		Expect(buffer.String()).ToNot(ContainSubstring(`"step"`))
+		Expect(lines()[0].Message).To(Equal("some info"))
+	})
+
+	It("only writes debug messages when BP_DEBUG is set", func() {
+		logger.Debug("hidden")
+		Expect(buffer.String()).To(BeEmpty())
+
+		os.Setenv("BP_DEBUG", "1")
+		logger.Debug("shown")
+		Expect(lines()[0].Level).To(Equal("debug"))
+	})
+})
+
+var _ = Describe("AdvisoryLogger", func() {
+	var (
+		buffer *bytes.Buffer
+		logger *supply.AdvisoryLogger
+	)
+
+	BeforeEach(func() {
+		buffer = new(bytes.Buffer)
+		logger = supply.NewAdvisoryLogger(libbuildpack.NewLogger(ansicleaner.New(buffer)))
+	})
+
+	AfterEach(func() {
+		os.Unsetenv("BP_ADVISORY_REPORT")
+	})
+
+	It("collects every warning", func() {
+		logger.Info("some info")
+		logger.Warning("first warning\nwith details")
+		logger.Warning("second %s", "warning")
+		Expect(logger.Advisories()).To(Equal([]string{"first warning\nwith details", "second warning"}))
+		Expect(buffer.String()).To(ContainSubstring("with details"))
+	})
+
+	It("summarizes the warnings in one report", func() {
+		logger.Warning("first warning\nwith details")
+		logger.Warning("second warning")
+		logger.Warning("first warning\nwith details")
+		buffer.Reset()
+
+		logger.ReportAdvisories()
+		Expect(buffer.String()).To(ContainSubstring("Advisories (2)"))
+		Expect(buffer.String()).To(ContainSubstring("1. first warning"))
+		Expect(buffer.String()).To(ContainSubstring("2. second warning"))
+		Expect(buffer.String()).ToNot(ContainSubstring("with details"))
+	})
+
+	It("does not report when there were no warnings", func() {
+		logger.ReportAdvisories()
+		Expect(buffer.String()).To(BeEmpty())
+	})
+
+	It("does not report when BP_ADVISORY_REPORT is false", func() {
+		os.Setenv("BP_ADVISORY_REPORT", "false")
+		logger.Warning("a warning")
+		buffer.Reset()
+		logger.ReportAdvisories()
+		Expect(buffer.String()).To(BeEmpty())
+	})
+})
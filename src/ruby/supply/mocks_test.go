@@ -192,6 +192,20 @@ func (mr *MockInstallerMockRecorder) InstallOnlyVersion(arg0, arg1 interface{})
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "InstallOnlyVersion", reflect.TypeOf((*MockInstaller)(nil).InstallOnlyVersion), arg0, arg1)
 }
 
+// FetchDependency mocks base method
+func (m *MockInstaller) FetchDependency(arg0 libbuildpack.Dependency, arg1 string) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "FetchDependency", arg0, arg1)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// FetchDependency indicates an expected call of FetchDependency
+func (mr *MockInstallerMockRecorder) FetchDependency(arg0, arg1 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "FetchDependency", reflect.TypeOf((*MockInstaller)(nil).FetchDependency), arg0, arg1)
+}
+
 // MockVersions is a mock of Versions interface
 type MockVersions struct {
 	ctrl     *gomock.Controller
@@ -241,19 +255,19 @@ func (mr *MockVersionsMockRecorder) GetBundlerVersion() *gomock.Call {
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetBundlerVersion", reflect.TypeOf((*MockVersions)(nil).GetBundlerVersion))
 }
 
-// CheckBundler2Compatibility mocks base method
-func (m *MockVersions) CheckBundler2Compatibility() (bool, error) {
+// CheckBundlerCompatibility mocks base method
+func (m *MockVersions) CheckBundlerCompatibility(arg0 string) (bool, error) {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "CheckBundler2Compatibility")
+	ret := m.ctrl.Call(m, "CheckBundlerCompatibility", arg0)
 	ret0, _ := ret[0].(bool)
 	ret1, _ := ret[1].(error)
 	return ret0, ret1
 }
 
-// CheckBundler2Compatibility indicates an expected call of CheckBundler2Compatibility
-func (mr *MockVersionsMockRecorder) CheckBundler2Compatibility() *gomock.Call {
+// CheckBundlerCompatibility indicates an expected call of CheckBundlerCompatibility
+func (mr *MockVersionsMockRecorder) CheckBundlerCompatibility(arg0 interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CheckBundler2Compatibility", reflect.TypeOf((*MockVersions)(nil).CheckBundler2Compatibility))
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CheckBundlerCompatibility", reflect.TypeOf((*MockVersions)(nil).CheckBundlerCompatibility), arg0)
 }
 
 // Engine mocks base method
@@ -301,6 +315,21 @@ func (mr *MockVersionsMockRecorder) JrubyVersion() *gomock.Call {
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "JrubyVersion", reflect.TypeOf((*MockVersions)(nil).JrubyVersion))
 }
 
+// TruffleRubyVersion mocks base method
+func (m *MockVersions) TruffleRubyVersion() (string, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "TruffleRubyVersion")
+	ret0, _ := ret[0].(string)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// TruffleRubyVersion indicates an expected call of TruffleRubyVersion
+func (mr *MockVersionsMockRecorder) TruffleRubyVersion() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "TruffleRubyVersion", reflect.TypeOf((*MockVersions)(nil).TruffleRubyVersion))
+}
+
 // RubyEngineVersion mocks base method
 func (m *MockVersions) RubyEngineVersion() (string, error) {
 	m.ctrl.T.Helper()
@@ -0,0 +1,363 @@
+package supply
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/Masterminds/semver"
+	"github.com/cloudfoundry/libbuildpack"
+	"github.com/kr/text"
+)
+
+// nodeVersionFiles hold just a node version, such as v12 or 12.18.3, in the
+// order they are consulted.
+var nodeVersionFiles = []string{".node-version", ".nvmrc"}
+
+// declaredNodeVersion returns the node version the app asks for, from the
+// engines field of package.json, else .node-version or .nvmrc, else the
+// nodejs line of .tool-versions, along with the file it came from. Both are empty when the
+// app does not declare one.
+func (s *Supplier) declaredNodeVersion() (string, string, error) {
+	var packageJSON struct {
+		Engines struct {
+			Node string `json:"node"`
+		} `json:"engines"`
+	}
+	if body, err := ioutil.ReadFile(filepath.Join(s.Stager.BuildDir(), "package.json")); err == nil {
+		if err := json.Unmarshal(body, &packageJSON); err != nil {
+			s.Log.Debug("Could not parse package.json: %v", err)
+		} else if packageJSON.Engines.Node != "" {
+			return strings.TrimSpace(packageJSON.Engines.Node), "package.json", nil
+		}
+	} else if !os.IsNotExist(err) {
+		return "", "", err
+	}
+
+	for _, name := range nodeVersionFiles {
+		if version, err := s.nodeVersionFile(name); err != nil || version != "" {
+			return version, name, err
+		}
+	}
+
+	if version, err := s.toolVersion("nodejs"); err != nil || version != "" {
+		return version, ToolVersionsFile, err
+	}
+
+	return "", "", nil
+}
+
+// packageBuildScripts are the package.json scripts jsbundling-rails and
+// cssbundling-rails run to build assets.
+var packageBuildScripts = []string{"build", "build:css"}
+
+// hasPackageBuildScript reports whether package.json defines a script that
+// builds assets, which needs node even when no gem asks for it.
+func (s *Supplier) hasPackageBuildScript() bool {
+	var packageJSON struct {
+		Scripts map[string]string `json:"scripts"`
+	}
+	body, err := ioutil.ReadFile(filepath.Join(s.Stager.BuildDir(), "package.json"))
+	if err != nil {
+		return false
+	}
+	if err := json.Unmarshal(body, &packageJSON); err != nil {
+		s.Log.Debug("Could not parse package.json: %v", err)
+		return false
+	}
+	for _, name := range packageBuildScripts {
+		if packageJSON.Scripts[name] != "" {
+			s.Log.Debug("Found the %s script in package.json", name)
+			return true
+		}
+	}
+	return false
+}
+
+// nvmAliases maps the nvm aliases apps commonly put in .nvmrc to a node
+// version requirement. The newest node stands in for lts/*, since the
+// manifest does not say which of its nodes are LTS releases.
+var nvmAliases = map[string]string{
+	"node":         "x",
+	"stable":       "x",
+	"lts/*":        "x",
+	"lts/argon":    "4",
+	"lts/boron":    "6",
+	"lts/carbon":   "8",
+	"lts/dubnium":  "10",
+	"lts/erbium":   "12",
+	"lts/fermium":  "14",
+	"lts/gallium":  "16",
+	"lts/hydrogen": "18",
+	"lts/iron":     "20",
+	"lts/jod":      "22",
+}
+
+// nodeVersionFile reads the node version in name, resolving nvm aliases. An
+// alias it cannot resolve, such as system, is warned about and ignored.
+func (s *Supplier) nodeVersionFile(name string) (string, error) {
+	body, err := ioutil.ReadFile(filepath.Join(s.Stager.BuildDir(), name))
+	if os.IsNotExist(err) {
+		return "", nil
+	} else if err != nil {
+		return "", err
+	}
+
+	version := strings.TrimSpace(string(body))
+	if alias, ok := nvmAliases[strings.ToLower(version)]; ok {
+		return alias, nil
+	} else if version != "" && !regexp.MustCompile(`^v?\d`).MatchString(version) {
+		s.Log.Warning("Ignoring node %s from %s, since it is not a node version or an nvm alias this buildpack knows", version, name)
+		return "", nil
+	}
+	return version, nil
+}
+
+// warnNodeVersionConflicts warns about node version files whose version
+// disagrees with the node chosen for package.json's engines, which wins.
+func (s *Supplier) warnNodeVersionConflicts(requirement, version string) {
+	chosen, err := semver.NewVersion(version)
+	if err != nil {
+		return
+	}
+	for _, name := range nodeVersionFiles {
+		other, err := s.nodeVersionFile(name)
+		if err != nil || other == "" {
+			continue
+		}
+		if constraint, err := semver.NewConstraint(nodeConstraint(other)); err == nil && constraint.Check(chosen) {
+			continue
+		}
+		s.Log.Warning("package.json asks for node %s, but %s asks for node %s.\nUsing node %s, since package.json takes precedence.", requirement, name, other, version)
+	}
+}
+
+// nodeConstraint turns a node version file or engines requirement into a semver
+// constraint: a leading v is dropped, partial versions such as 10 or 10.16
+// match any patch, and space separated comparisons are all required.
+func nodeConstraint(requirement string) string {
+	requirement = strings.TrimPrefix(strings.TrimSpace(requirement), "v")
+	if regexp.MustCompile(`^\d+(\.\d+)?$`).MatchString(requirement) {
+		return requirement + ".x"
+	}
+	return regexp.MustCompile(`(\d)\s+([<>=~^])`).ReplaceAllString(requirement, "$1, $2")
+}
+
+// checkSuppliedNode compares node supplied by an earlier buildpack against
+// the app's declared requirement. A node that is too old is kept with a
+// warning, or is replaced by the manifest's node when
+// BP_REPLACE_SUPPLIED_NODE=true, in which case it returns true.
+func (s *Supplier) checkSuppliedNode() bool {
+	requirement, source, err := s.declaredNodeVersion()
+	if err != nil || requirement == "" {
+		return false
+	}
+
+	constraint, err := semver.NewConstraint(nodeConstraint(requirement))
+	if err != nil {
+		s.Log.Debug("Could not parse node requirement %s from %s: %v", requirement, source, err)
+		return false
+	}
+
+	output, err := s.Command.Output(s.Stager.BuildDir(), "node", "--version")
+	if err != nil {
+		return false
+	}
+	supplied, err := semver.NewVersion(strings.TrimPrefix(strings.TrimSpace(output), "v"))
+	if err != nil {
+		s.Log.Debug("Could not parse supplied node version %s: %v", output, err)
+		return false
+	}
+
+	if constraint.Check(supplied) {
+		return false
+	}
+
+	if os.Getenv("BP_REPLACE_SUPPLIED_NODE") == "true" {
+		s.Log.Warning("The supplied node %s does not satisfy %s from %s, installing node instead", supplied, requirement, source)
+		return true
+	}
+	s.Log.Warning("The supplied node %s does not satisfy %s from %s.\nAsset builds may fail. Set BP_REPLACE_SUPPLIED_NODE=true to install a node that satisfies it instead.", supplied, requirement, source)
+	return false
+}
+
+// nodeVersion picks the manifest's node for the app's declared requirement,
+// or the newest node when it declares none. NODE_VERSION_STRATEGY decides
+// what happens when no available node satisfies the requirement: strict (the
+// default) fails, nearest uses the newest node of the closest major.
+func (s *Supplier) nodeVersion() (string, error) {
+	versions := s.Manifest.AllDependencyVersions("node")
+
+	requirement, source, err := s.declaredNodeVersion()
+	if err != nil {
+		return "", err
+	}
+	if requirement == "" {
+		version, err := libbuildpack.FindMatchingVersion("x", versions)
+		if err == nil {
+			s.Log.Debug("Node version %s determined by the newest available node", version)
+		}
+		return version, err
+	}
+
+	if version, err := libbuildpack.FindMatchingVersion(nodeConstraint(requirement), versions); err == nil {
+		s.Log.Debug("Node version %s determined by %s", version, source)
+		if source == "package.json" {
+			s.warnNodeVersionConflicts(requirement, version)
+		}
+		return version, nil
+	}
+
+	switch strategy := os.Getenv("NODE_VERSION_STRATEGY"); strategy {
+	case "", "strict":
+		return "", fmt.Errorf("%s asks for node %s, which this buildpack does not provide (available: %s).\nSet NODE_VERSION_STRATEGY=nearest to use the closest available node instead.", source, requirement, strings.Join(versions, ", "))
+	case "nearest":
+		version, err := nearestMajorVersion(requirement, versions)
+		if err != nil {
+			return "", fmt.Errorf("%s asks for node %s, which this buildpack does not provide: %v", source, requirement, err)
+		}
+		s.Log.Warning("%s asks for node %s, which this buildpack does not provide.\nUsing node %s, the closest available, since NODE_VERSION_STRATEGY=nearest.", source, requirement, version)
+		return version, nil
+	default:
+		return "", fmt.Errorf("NODE_VERSION_STRATEGY must be strict or nearest, not %s", strategy)
+	}
+}
+
+// nearestMajorVersion returns the newest version whose major is closest to
+// the first major named in requirement, preferring the newer major on a tie.
+func nearestMajorVersion(requirement string, versions []string) (string, error) {
+	match := regexp.MustCompile(`\d+`).FindString(requirement)
+	if match == "" {
+		return "", fmt.Errorf("could not find a major version in %s", requirement)
+	}
+	wanted, _ := strconv.ParseInt(match, 10, 64)
+
+	var nearest *semver.Version
+	for _, v := range versions {
+		version, err := semver.NewVersion(v)
+		if err != nil {
+			continue
+		}
+		if nearest == nil {
+			nearest = version
+			continue
+		}
+		distance, best := majorDistance(version.Major(), wanted), majorDistance(nearest.Major(), wanted)
+		if distance < best || (distance == best && version.GreaterThan(nearest)) {
+			nearest = version
+		}
+	}
+	if nearest == nil {
+		return "", fmt.Errorf("no node versions are available")
+	}
+	return nearest.Original(), nil
+}
+
+func majorDistance(major, wanted int64) int64 {
+	if major > wanted {
+		return major - wanted
+	}
+	return wanted - major
+}
+
+// InstallNodeModules runs yarn install for apps with a yarn.lock and no
+// pnpm-lock.yaml. The node_modules restored from the cache is reused when it
+// was installed from the same yarn.lock by the same node major, since native
+// modules are built against the node they were installed with. The result is
+// saved to the cache afterwards.
+func (s *Supplier) InstallNodeModules() error {
+	cachedModules := filepath.Join(s.Stager.DepDir(), "node_modules")
+	defer os.RemoveAll(cachedModules)
+
+	yarnLockChecksum, err := fileChecksum(filepath.Join(s.Stager.BuildDir(), "yarn.lock"))
+	if err != nil || yarnLockChecksum == "" {
+		return err
+	}
+	if usesPnpm, err := s.usesPnpm(); err != nil || usesPnpm {
+		return err
+	}
+
+	output, err := s.Command.Output(s.Stager.BuildDir(), "node", "--version")
+	if err != nil {
+		return fmt.Errorf("could not determine the node version: %v", err)
+	}
+	nodeMajor := strings.SplitN(strings.TrimPrefix(strings.TrimSpace(output), "v"), ".", 2)[0]
+
+	if err := s.restoreNodeModules(cachedModules, yarnLockChecksum, nodeMajor); err != nil {
+		return err
+	}
+
+	args := []string{"install", "--frozen-lockfile", "--non-interactive"}
+	if yarnPath, err := s.yarnBerryPath(); err != nil {
+		return err
+	} else if yarnPath != "" {
+		args = []string{"install", "--immutable"}
+	}
+
+	s.Log.BeginStep("Installing node modules using yarn")
+	if err := s.Command.Execute(s.Stager.BuildDir(), text.NewIndentWriter(os.Stdout, []byte("       ")), text.NewIndentWriter(os.Stderr, []byte("       ")), "yarn", args...); err != nil {
+		return fmt.Errorf("yarn install failed: %v", err)
+	}
+
+	metadata := s.Cache.Metadata()
+	metadata.YarnLockChecksum, metadata.NodeMajor = yarnLockChecksum, nodeMajor
+	return nil
+}
+
+// yarnBerryPath returns the yarnPath from .yarnrc.yml, the project-local yarn
+// release that yarn 2+ (berry) projects pin. The buildpack's classic yarn
+// hands every command to it, so it is never replaced. It is empty for yarn
+// classic projects.
+func (s *Supplier) yarnBerryPath() (string, error) {
+	source := filepath.Join(s.Stager.BuildDir(), ".yarnrc.yml")
+	if exists, err := libbuildpack.FileExists(source); err != nil || !exists {
+		return "", err
+	}
+
+	var yarnrc struct {
+		YarnPath string `yaml:"yarnPath"`
+	}
+	if err := libbuildpack.NewYAML().Load(source, &yarnrc); err != nil {
+		return "", fmt.Errorf("could not parse .yarnrc.yml: %v", err)
+	}
+	if yarnrc.YarnPath == "" {
+		return "", nil
+	}
+
+	if exists, err := libbuildpack.FileExists(filepath.Join(s.Stager.BuildDir(), yarnrc.YarnPath)); err != nil {
+		return "", err
+	} else if !exists {
+		return "", fmt.Errorf("the yarnPath %s in .yarnrc.yml does not exist", yarnrc.YarnPath)
+	}
+	return yarnrc.YarnPath, nil
+}
+
+func (s *Supplier) restoreNodeModules(cachedModules, yarnLockChecksum, nodeMajor string) error {
+	if exists, err := libbuildpack.FileExists(cachedModules); err != nil || !exists {
+		return err
+	}
+	if exists, err := libbuildpack.FileExists(filepath.Join(s.Stager.BuildDir(), "node_modules")); err != nil {
+		return err
+	} else if exists {
+		s.Log.Debug("Not restoring node_modules from the cache, since the app has its own")
+		return nil
+	}
+
+	metadata := s.Cache.Metadata()
+	if metadata.YarnLockChecksum != yarnLockChecksum {
+		s.Log.Debug("Not restoring node_modules from the cache, since yarn.lock changed")
+		return nil
+	}
+	if metadata.NodeMajor != nodeMajor {
+		s.Log.Info("Reinstalling node modules, since the cached ones were installed with node %s rather than node %s", metadata.NodeMajor, nodeMajor)
+		return nil
+	}
+
+	s.Log.Info("Restoring node_modules from the cache")
+	return os.Rename(cachedModules, filepath.Join(s.Stager.BuildDir(), "node_modules"))
+}
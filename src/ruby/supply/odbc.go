@@ -0,0 +1,129 @@
+package supply
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/cloudfoundry/libbuildpack"
+)
+
+// FreeTDSODBCDriver is the name odbcinst.ini gives the FreeTDS ODBC driver,
+// which DSNs and connection strings refer to with Driver=FreeTDS.
+const FreeTDSODBCDriver = "FreeTDS"
+
+// NeedsUnixODBC reports whether the app connects through ruby-odbc, which
+// needs unixODBC and the FreeTDS ODBC driver rather than dblib.
+func (s *Supplier) NeedsUnixODBC() bool {
+	hasGem, err := s.Versions.HasGemVersion("ruby-odbc", ">=0.0.0")
+	return err == nil && hasGem
+}
+
+// freeTDSODBCDriverPath finds libtdsodbc.so in the lib or lib64 dir of the
+// installed FreeTDS and returns where it lives in the running droplet, or
+// empty when FreeTDS was built without its ODBC driver.
+func (s *Supplier) freeTDSODBCDriverPath() (string, error) {
+	for _, libDir := range freeTDSODBCLibDirs {
+		if exists, err := libbuildpack.FileExists(filepath.Join(s.Stager.DepDir(), "freetds", libDir, "libtdsodbc.so")); err != nil {
+			return "", err
+		} else if exists {
+			return fmt.Sprintf("%s/freetds/%s/libtdsodbc.so", s.runtimeDepDir(), libDir), nil
+		}
+	}
+	return "", nil
+}
+
+var freeTDSODBCLibDirs = []string{"lib", "lib64"}
+
+// odbcSysIniDir is the dep dir's ODBCSYSINI, where unixODBC looks for both
+// odbcinst.ini and odbc.ini. unixODBC joins ODBCINSTINI onto it, so ODBCINSTINI
+// can only be a file name.
+const odbcSysIniDir = "odbc"
+
+// odbcInstIniScript returns profile.d lines that write an odbcinst.ini
+// declaring the FreeTDS driver into ODBCSYSINI as the app starts. unixODBC
+// does not expand variables in its ini files, so the driver's absolute path is
+// only known at runtime.
+func (s *Supplier) odbcInstIniScript() (string, error) {
+	driverPath, err := s.freeTDSODBCDriverPath()
+	if err != nil {
+		return "", err
+	} else if driverPath == "" {
+		return "", fmt.Errorf("libtdsodbc.so is not in %s of %s, so the installed FreeTDS has no ODBC driver for ruby-odbc", strings.Join(freeTDSODBCLibDirs, " or "), filepath.Join(s.Stager.DepDir(), "freetds"))
+	}
+	odbcInstIni := renderFreeTDSConf([]freeTDSConfSection{{
+		name: FreeTDSODBCDriver,
+		settings: [][2]string{
+			{"Description", "FreeTDS supplied by the ruby-freetds buildpack"},
+			{"Driver", driverPath},
+		},
+	}})
+	return fmt.Sprintf("cat > \"$ODBCSYSINI/$ODBCINSTINI\" <<ODBCINSTINI\n%sODBCINSTINI\n", odbcInstIni), nil
+}
+
+// WriteODBCInstIni points ODBCSYSINI at the dep dir's odbc dir and declares
+// the FreeTDS driver in an odbcinst.ini there, so whichever unixODBC the app
+// ends up loading, the stack's or InstallUnixODBC's, finds the driver.
+func (s *Supplier) WriteODBCInstIni() error {
+	script, err := s.odbcInstIniScript()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Join(s.Stager.DepDir(), odbcSysIniDir), 0755); err != nil {
+		return err
+	}
+	return s.writeRuntimeProfileD("freetds_odbc.sh", fmt.Sprintf("export ODBCSYSINI=\"%s/%s\"\nexport ODBCINSTINI=odbcinst.ini\n%s", s.runtimeDepDir(), odbcSysIniDir, script))
+}
+
+func unixODBCEnabled() bool {
+	return os.Getenv("BP_INSTALL_UNIXODBC") == "true"
+}
+
+// InstallUnixODBC installs the manifest's unixODBC when BP_INSTALL_UNIXODBC
+// is true, otherwise the app uses the stack's. It writes an odbc.ini next to
+// WriteODBCInstIni's odbcinst.ini, with a DSN for each server in freetds.yml
+// that uses the server of the same name in freetds.conf.
+func (s *Supplier) InstallUnixODBC() error {
+	if !unixODBCEnabled() {
+		return nil
+	}
+	if len(s.Manifest.AllDependencyVersions("unixodbc")) == 0 {
+		s.Log.Warning("BP_INSTALL_UNIXODBC is true, but this buildpack does not provide unixODBC, so the stack's unixODBC will be used")
+		return nil
+	}
+
+	s.Log.BeginStep("Supplying unixODBC")
+
+	installDir := filepath.Join(s.Stager.DepDir(), "unixodbc")
+	if err := s.Installer.InstallOnlyVersion("unixodbc", installDir); err != nil {
+		return err
+	}
+	if err := s.Stager.LinkDirectoryInDepDir(filepath.Join(installDir, "bin"), "bin"); err != nil {
+		return err
+	}
+
+	config, err := s.loadFreeTDSConfig()
+	if err != nil {
+		return err
+	}
+	var dsns []freeTDSConfSection
+	if config != nil {
+		for _, server := range config.Servers {
+			dsns = append(dsns, freeTDSConfSection{
+				name: server.Name,
+				settings: [][2]string{
+					{"Driver", FreeTDSODBCDriver},
+					{"Servername", server.Name},
+				},
+			})
+		}
+	}
+
+	iniDir := filepath.Join(s.Stager.DepDir(), odbcSysIniDir)
+	if err := os.MkdirAll(iniDir, 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(iniDir, "odbc.ini"), []byte(renderFreeTDSConf(dsns)), 0644)
+}
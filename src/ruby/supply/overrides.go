@@ -0,0 +1,149 @@
+package supply
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/cloudfoundry/libbuildpack"
+)
+
+const DependencyOverridesFile = "dependency_overrides.yml"
+
+type DependencyOverride struct {
+	Name    string `yaml:"name"`
+	Version string `yaml:"version"`
+	URI     string `yaml:"uri"`
+	SHA256  string `yaml:"sha256"`
+}
+
+// OverrideInstaller installs dependencies pinned in the app's
+// dependency_overrides.yml from their pinned uri, verifying the pinned
+// sha256, and defers everything else to the wrapped Installer.
+type OverrideInstaller struct {
+	Installer Installer
+	Overrides []DependencyOverride
+	Source    string
+	Log       Logger
+}
+
+// NewOverrideInstaller returns installer unchanged when the app has no
+// dependency_overrides.yml.
+func NewOverrideInstaller(installer Installer, buildDir string, log Logger) (Installer, error) {
+	source := filepath.Join(buildDir, DependencyOverridesFile)
+	if exists, err := libbuildpack.FileExists(source); err != nil {
+		return nil, err
+	} else if !exists {
+		return installer, nil
+	}
+
+	var file struct {
+		Dependencies []DependencyOverride `yaml:"dependencies"`
+	}
+	if err := libbuildpack.NewYAML().Load(source, &file); err != nil {
+		return nil, fmt.Errorf("could not parse %s: %v", DependencyOverridesFile, err)
+	}
+
+	for _, o := range file.Dependencies {
+		if o.Name == "" || o.URI == "" || o.SHA256 == "" {
+			return nil, fmt.Errorf("%s: every dependency needs a name, uri and sha256", DependencyOverridesFile)
+		}
+	}
+
+	return &OverrideInstaller{Installer: installer, Overrides: file.Dependencies, Source: source, Log: log}, nil
+}
+
+func (o *OverrideInstaller) override(dep libbuildpack.Dependency) (DependencyOverride, bool) {
+	for _, override := range o.Overrides {
+		if override.Name == dep.Name && (override.Version == "" || override.Version == dep.Version) {
+			return override, true
+		}
+	}
+	return DependencyOverride{}, false
+}
+
+func (o *OverrideInstaller) InstallDependency(dep libbuildpack.Dependency, outputDir string) error {
+	override, found := o.override(dep)
+	if !found {
+		return o.Installer.InstallDependency(dep, outputDir)
+	}
+
+	o.Log.BeginStep("Installing %s %s", dep.Name, dep.Version)
+
+	tmpDir, err := ioutil.TempDir("", "downloads")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmpDir)
+
+	tmpFile := filepath.Join(tmpDir, "archive")
+	if err := o.FetchDependency(dep, tmpFile); err != nil {
+		return err
+	}
+
+	if strings.HasSuffix(override.URI, ".sh") {
+		return os.Rename(tmpFile, outputDir)
+	}
+	if err := os.MkdirAll(outputDir, 0755); err != nil {
+		return err
+	}
+	if strings.HasSuffix(override.URI, ".zip") {
+		return libbuildpack.ExtractZip(tmpFile, outputDir)
+	}
+	if strings.HasSuffix(override.URI, ".tar.xz") {
+		return libbuildpack.ExtractTarXz(tmpFile, outputDir)
+	}
+	return libbuildpack.ExtractTarGz(tmpFile, outputDir)
+}
+
+func (o *OverrideInstaller) InstallOnlyVersion(depName, installDir string) error {
+	for _, override := range o.Overrides {
+		if override.Name == depName && override.Version != "" {
+			return o.InstallDependency(libbuildpack.Dependency{Name: depName, Version: override.Version}, installDir)
+		}
+	}
+	return o.Installer.InstallOnlyVersion(depName, installDir)
+}
+
+func (o *OverrideInstaller) FetchDependency(dep libbuildpack.Dependency, outputFile string) error {
+	override, found := o.override(dep)
+	if !found {
+		return o.Installer.FetchDependency(dep, outputFile)
+	}
+
+	o.Log.Info("Using %s %s from %s as pinned in %s", dep.Name, dep.Version, override.URI, o.Source)
+
+	if err := downloadOverride(override.URI, outputFile); err != nil {
+		return fmt.Errorf("could not download %s %s from %s: %v", dep.Name, dep.Version, override.URI, err)
+	}
+	if err := libbuildpack.CheckSha256(outputFile, override.SHA256); err != nil {
+		os.Remove(outputFile)
+		return fmt.Errorf("%s %s from %s: %v", dep.Name, dep.Version, o.Source, err)
+	}
+	return nil
+}
+
+func downloadOverride(uri, outputFile string) error {
+	resp, err := http.Get(uri)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("status %d", resp.StatusCode)
+	}
+
+	file, err := os.Create(outputFile)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	_, err = io.Copy(file, resp.Body)
+	return err
+}
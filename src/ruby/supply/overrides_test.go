@@ -0,0 +1,148 @@
+package supply_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+
+	"github.com/cloudfoundry/ruby-buildpack/src/ruby/supply"
+
+	"github.com/cloudfoundry/libbuildpack"
+	"github.com/cloudfoundry/libbuildpack/ansicleaner"
+	"github.com/golang/mock/gomock"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("OverrideInstaller", func() {
+	var (
+		err           error
+		buildDir      string
+		outputDir     string
+		buffer        *bytes.Buffer
+		logger        *libbuildpack.Logger
+		mockCtrl      *gomock.Controller
+		mockInstaller *MockInstaller
+		server        *httptest.Server
+		archive       []byte
+		installer     supply.Installer
+	)
+
+	writeOverrides := func(sha string) {
+		Expect(ioutil.WriteFile(filepath.Join(buildDir, "dependency_overrides.yml"), []byte(fmt.Sprintf(`---
+dependencies:
+- name: freetds
+  version: 1.1.6
+  uri: %s/freetds-1.1.6.tgz
+  sha256: %s
+`, server.URL, sha)), 0644)).To(Succeed())
+	}
+
+	BeforeEach(func() {
+		buildDir, err = ioutil.TempDir("", "ruby-buildpack.build.")
+		Expect(err).To(BeNil())
+		outputDir, err = ioutil.TempDir("", "ruby-buildpack.output.")
+		Expect(err).To(BeNil())
+
+		buffer = new(bytes.Buffer)
+		logger = libbuildpack.NewLogger(ansicleaner.New(buffer))
+
+		mockCtrl = gomock.NewController(GinkgoT())
+		mockInstaller = NewMockInstaller(mockCtrl)
+
+		var tgz bytes.Buffer
+		gz := gzip.NewWriter(&tgz)
+		tw := tar.NewWriter(gz)
+		contents := []byte("pinned freetds")
+		Expect(tw.WriteHeader(&tar.Header{Name: "lib/libsybdb.so", Mode: 0644, Size: int64(len(contents)), Typeflag: tar.TypeReg})).To(Succeed())
+		_, err = tw.Write(contents)
+		Expect(err).To(BeNil())
+		Expect(tw.Close()).To(Succeed())
+		Expect(gz.Close()).To(Succeed())
+		archive = tgz.Bytes()
+
+		server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write(archive)
+		}))
+	})
+
+	AfterEach(func() {
+		server.Close()
+		mockCtrl.Finish()
+		Expect(os.RemoveAll(buildDir)).To(Succeed())
+		Expect(os.RemoveAll(outputDir)).To(Succeed())
+	})
+
+	Context("the app has no dependency_overrides.yml", func() {
+		It("returns the wrapped installer", func() {
+			installer, err = supply.NewOverrideInstaller(mockInstaller, buildDir, logger)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(installer).To(Equal(mockInstaller))
+		})
+	})
+
+	Context("the app pins a dependency", func() {
+		Context("with a matching sha256", func() {
+			BeforeEach(func() {
+				sum := sha256.Sum256(archive)
+				writeOverrides(hex.EncodeToString(sum[:]))
+				installer, err = supply.NewOverrideInstaller(mockInstaller, buildDir, logger)
+				Expect(err).ToNot(HaveOccurred())
+			})
+
+			It("installs the pinned dependency from the pinned uri", func() {
+				Expect(installer.InstallDependency(libbuildpack.Dependency{Name: "freetds", Version: "1.1.6"}, outputDir)).To(Succeed())
+				Expect(ioutil.ReadFile(filepath.Join(outputDir, "lib", "libsybdb.so"))).To(Equal([]byte("pinned freetds")))
+			})
+
+			It("logs the override source", func() {
+				Expect(installer.InstallDependency(libbuildpack.Dependency{Name: "freetds", Version: "1.1.6"}, outputDir)).To(Succeed())
+				Expect(buffer.String()).To(ContainSubstring("Using freetds 1.1.6 from " + server.URL + "/freetds-1.1.6.tgz as pinned in " + filepath.Join(buildDir, "dependency_overrides.yml")))
+			})
+
+			It("uses the buildpack's manifest for other dependencies", func() {
+				mockInstaller.EXPECT().InstallDependency(libbuildpack.Dependency{Name: "ruby", Version: "2.6.3"}, outputDir)
+				Expect(installer.InstallDependency(libbuildpack.Dependency{Name: "ruby", Version: "2.6.3"}, outputDir)).To(Succeed())
+			})
+
+			It("uses the buildpack's manifest for other versions of the dependency", func() {
+				mockInstaller.EXPECT().InstallDependency(libbuildpack.Dependency{Name: "freetds", Version: "1.1.5"}, outputDir)
+				Expect(installer.InstallDependency(libbuildpack.Dependency{Name: "freetds", Version: "1.1.5"}, outputDir)).To(Succeed())
+			})
+		})
+
+		Context("with a mismatched sha256", func() {
+			BeforeEach(func() {
+				writeOverrides("0000000000000000000000000000000000000000000000000000000000000000")
+				installer, err = supply.NewOverrideInstaller(mockInstaller, buildDir, logger)
+				Expect(err).ToNot(HaveOccurred())
+			})
+
+			It("fails without installing", func() {
+				err := installer.InstallDependency(libbuildpack.Dependency{Name: "freetds", Version: "1.1.6"}, outputDir)
+				Expect(err).To(HaveOccurred())
+				Expect(err.Error()).To(ContainSubstring("dependency sha256 mismatch"))
+				Expect(filepath.Join(outputDir, "lib", "libsybdb.so")).ToNot(BeAnExistingFile())
+			})
+		})
+
+		Context("without a sha256", func() {
+			BeforeEach(func() {
+				writeOverrides("")
+			})
+
+			It("refuses the overrides file", func() {
+				_, err := supply.NewOverrideInstaller(mockInstaller, buildDir, logger)
+				Expect(err).To(MatchError("dependency_overrides.yml: every dependency needs a name, uri and sha256"))
+			})
+		})
+	})
+})
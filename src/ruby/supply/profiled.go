@@ -0,0 +1,43 @@
+package supply
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// ValidateAppProfileD checks that each of the app's own .profile.d/*.sh
+// scripts parses with bash -n, so a broken script fails staging instead of
+// silently failing when the app starts. The platform sources them itself,
+// in filename order after the buildpacks' profile.d scripts, so they are
+// checked where they are and left in place.
+func (s *Supplier) ValidateAppProfileD() error {
+	appProfileD := filepath.Join(s.Stager.BuildDir(), ".profile.d")
+	files, err := ioutil.ReadDir(appProfileD)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	var scripts []string
+	for _, file := range files {
+		if file.Mode().IsRegular() && strings.HasSuffix(file.Name(), ".sh") {
+			scripts = append(scripts, file.Name())
+		}
+	}
+	sort.Strings(scripts)
+
+	for _, name := range scripts {
+		output := new(bytes.Buffer)
+		if err := s.Command.Execute(s.Stager.BuildDir(), output, output, "bash", "-n", filepath.Join(appProfileD, name)); err != nil {
+			return fmt.Errorf(".profile.d/%s is not a valid bash script: %s", name, strings.TrimSpace(output.String()))
+		}
+		s.Log.Debug("Checked .profile.d/%s", name)
+	}
+	return nil
+}
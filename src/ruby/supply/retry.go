@@ -0,0 +1,112 @@
+package supply
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cloudfoundry/libbuildpack"
+)
+
+const (
+	defaultInstallAttempts = 3
+	defaultInstallBackoff  = 2 * time.Second
+)
+
+// RetryInstaller retries dependency installs and downloads that fail on a
+// transient network error, waiting Backoff before the second attempt and
+// twice as long before each one after that. Permanent failures, such as a
+// version missing from the manifest or a 404, are returned at once.
+type RetryInstaller struct {
+	Installer Installer
+	Attempts  int
+	Backoff   time.Duration
+	Log       Logger
+	Sleep     func(time.Duration)
+}
+
+// NewRetryInstaller wraps installer with BP_INSTALL_ATTEMPTS attempts (3 by
+// default) and a BP_INSTALL_BACKOFF initial backoff (a duration such as 5s,
+// 2s by default).
+func NewRetryInstaller(installer Installer, log Logger) (*RetryInstaller, error) {
+	attempts := defaultInstallAttempts
+	if value := os.Getenv("BP_INSTALL_ATTEMPTS"); value != "" {
+		var err error
+		if attempts, err = strconv.Atoi(value); err != nil || attempts < 1 {
+			return nil, fmt.Errorf("BP_INSTALL_ATTEMPTS %s is not a positive number of attempts", value)
+		}
+	}
+	backoff := defaultInstallBackoff
+	if value := os.Getenv("BP_INSTALL_BACKOFF"); value != "" {
+		var err error
+		if backoff, err = time.ParseDuration(value); err != nil || backoff < 0 {
+			return nil, fmt.Errorf("BP_INSTALL_BACKOFF %s is not a duration", value)
+		}
+	}
+	return &RetryInstaller{Installer: installer, Attempts: attempts, Backoff: backoff, Log: log, Sleep: time.Sleep}, nil
+}
+
+func (r *RetryInstaller) InstallDependency(dep libbuildpack.Dependency, outputDir string) error {
+	return r.retry(fmt.Sprintf("%s %s", dep.Name, dep.Version), func() error {
+		return r.Installer.InstallDependency(dep, outputDir)
+	})
+}
+
+func (r *RetryInstaller) InstallOnlyVersion(depName, installDir string) error {
+	return r.retry(depName, func() error {
+		return r.Installer.InstallOnlyVersion(depName, installDir)
+	})
+}
+
+func (r *RetryInstaller) FetchDependency(dep libbuildpack.Dependency, outputFile string) error {
+	return r.retry(fmt.Sprintf("%s %s", dep.Name, dep.Version), func() error {
+		return r.Installer.FetchDependency(dep, outputFile)
+	})
+}
+
+func (r *RetryInstaller) retry(name string, install func() error) error {
+	backoff := r.Backoff
+	for attempt := 1; ; attempt++ {
+		err := install()
+		if err == nil || attempt >= r.Attempts || !isTransientInstallError(err) {
+			return err
+		}
+		r.Log.Warning("Installing %s failed (%v), retrying in %s (attempt %d of %d)", name, err, backoff, attempt+1, r.Attempts)
+		r.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// transientDownloadStatus matches the download failures of libbuildpack and
+// OverrideInstaller for statuses that are worth retrying.
+var transientDownloadStatus = regexp.MustCompile(`(could not download: |status )(5\d\d|429)$`)
+
+// transientNetworkErrors are the messages of network errors that were
+// flattened into a string on their way up, e.g. by fmt.Errorf.
+var transientNetworkErrors = []string{"connection reset", "connection refused", "i/o timeout", "TLS handshake timeout", "unexpected EOF"}
+
+func isTransientInstallError(err error) bool {
+	if urlErr, ok := err.(*url.Error); ok {
+		err = urlErr.Err
+	}
+	if _, ok := err.(net.Error); ok || err == io.ErrUnexpectedEOF {
+		return true
+	}
+
+	message := err.Error()
+	if transientDownloadStatus.MatchString(message) {
+		return true
+	}
+	for _, transient := range transientNetworkErrors {
+		if strings.Contains(message, transient) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,121 @@
+package supply_test
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"os"
+	"time"
+
+	"github.com/cloudfoundry/ruby-buildpack/src/ruby/supply"
+
+	"github.com/cloudfoundry/libbuildpack"
+	"github.com/cloudfoundry/libbuildpack/ansicleaner"
+	"github.com/golang/mock/gomock"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("RetryInstaller", func() {
+	var (
+		buffer        *bytes.Buffer
+		logger        *libbuildpack.Logger
+		mockCtrl      *gomock.Controller
+		mockInstaller *MockInstaller
+		installer     *supply.RetryInstaller
+		sleeps        []time.Duration
+		dep           libbuildpack.Dependency
+	)
+
+	BeforeEach(func() {
+		buffer = new(bytes.Buffer)
+		logger = libbuildpack.NewLogger(ansicleaner.New(buffer))
+
+		mockCtrl = gomock.NewController(GinkgoT())
+		mockInstaller = NewMockInstaller(mockCtrl)
+
+		var err error
+		installer, err = supply.NewRetryInstaller(mockInstaller, logger)
+		Expect(err).ToNot(HaveOccurred())
+		sleeps = nil
+		installer.Sleep = func(d time.Duration) { sleeps = append(sleeps, d) }
+
+		dep = libbuildpack.Dependency{Name: "ruby", Version: "2.6.3"}
+	})
+
+	AfterEach(func() {
+		mockCtrl.Finish()
+		os.Unsetenv("BP_INSTALL_ATTEMPTS")
+		os.Unsetenv("BP_INSTALL_BACKOFF")
+	})
+
+	It("installs without retrying when the first attempt succeeds", func() {
+		mockInstaller.EXPECT().InstallDependency(dep, "/out").Return(nil)
+		Expect(installer.InstallDependency(dep, "/out")).To(Succeed())
+		Expect(sleeps).To(BeEmpty())
+	})
+
+	It("retries network errors with exponential backoff", func() {
+		gomock.InOrder(
+			mockInstaller.EXPECT().InstallDependency(dep, "/out").Return(&net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}),
+			mockInstaller.EXPECT().InstallDependency(dep, "/out").Return(errors.New("could not download: 503")),
+			mockInstaller.EXPECT().InstallDependency(dep, "/out").Return(nil),
+		)
+		Expect(installer.InstallDependency(dep, "/out")).To(Succeed())
+		Expect(sleeps).To(Equal([]time.Duration{2 * time.Second, 4 * time.Second}))
+		Expect(buffer.String()).To(ContainSubstring("Installing ruby 2.6.3 failed (could not download: 503), retrying in 4s (attempt 3 of 3)"))
+	})
+
+	It("gives up after the last attempt", func() {
+		mockInstaller.EXPECT().InstallDependency(dep, "/out").Return(errors.New("read: connection reset by peer")).Times(3)
+		Expect(installer.InstallDependency(dep, "/out")).To(MatchError("read: connection reset by peer"))
+		Expect(sleeps).To(HaveLen(2))
+	})
+
+	It("does not retry a download that was not found", func() {
+		mockInstaller.EXPECT().InstallDependency(dep, "/out").Return(errors.New("could not download: 404"))
+		Expect(installer.InstallDependency(dep, "/out")).To(MatchError("could not download: 404"))
+		Expect(sleeps).To(BeEmpty())
+	})
+
+	It("does not retry a version missing from the manifest", func() {
+		mockInstaller.EXPECT().InstallDependency(dep, "/out").Return(errors.New("dependency ruby 2.6.3 not found"))
+		Expect(installer.InstallDependency(dep, "/out")).To(MatchError("dependency ruby 2.6.3 not found"))
+		Expect(sleeps).To(BeEmpty())
+	})
+
+	It("retries the downloads of FetchDependency too", func() {
+		gomock.InOrder(
+			mockInstaller.EXPECT().FetchDependency(dep, "/archive").Return(errors.New("could not download ruby 2.6.3 from https://example.com/ruby.tgz: status 502")),
+			mockInstaller.EXPECT().FetchDependency(dep, "/archive").Return(nil),
+		)
+		Expect(installer.FetchDependency(dep, "/archive")).To(Succeed())
+		Expect(sleeps).To(HaveLen(1))
+	})
+
+	Context("BP_INSTALL_ATTEMPTS and BP_INSTALL_BACKOFF are set", func() {
+		It("uses them", func() {
+			os.Setenv("BP_INSTALL_ATTEMPTS", "2")
+			os.Setenv("BP_INSTALL_BACKOFF", "10s")
+			var err error
+			installer, err = supply.NewRetryInstaller(mockInstaller, logger)
+			Expect(err).ToNot(HaveOccurred())
+			installer.Sleep = func(d time.Duration) { sleeps = append(sleeps, d) }
+
+			mockInstaller.EXPECT().InstallOnlyVersion("yarn", "/out").Return(errors.New("i/o timeout")).Times(2)
+			Expect(installer.InstallOnlyVersion("yarn", "/out")).To(MatchError("i/o timeout"))
+			Expect(sleeps).To(Equal([]time.Duration{10 * time.Second}))
+		})
+
+		It("fails when they are invalid", func() {
+			os.Setenv("BP_INSTALL_ATTEMPTS", "0")
+			_, err := supply.NewRetryInstaller(mockInstaller, logger)
+			Expect(err).To(MatchError("BP_INSTALL_ATTEMPTS 0 is not a positive number of attempts"))
+
+			os.Setenv("BP_INSTALL_ATTEMPTS", "3")
+			os.Setenv("BP_INSTALL_BACKOFF", "soon")
+			_, err = supply.NewRetryInstaller(mockInstaller, logger)
+			Expect(err).To(MatchError("BP_INSTALL_BACKOFF soon is not a duration"))
+		})
+	})
+})
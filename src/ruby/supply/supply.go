@@ -2,7 +2,9 @@ package supply
 
 import (
 	"bytes"
+	"context"
 	"crypto/md5"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -10,10 +12,17 @@ import (
 	"os/exec"
 	"path/filepath"
 	"regexp"
+	"runtime"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
+	"github.com/Masterminds/semver"
 	"github.com/cloudfoundry/libbuildpack"
 	"github.com/cloudfoundry/ruby-buildpack/src/ruby/cache"
+	"github.com/cloudfoundry/ruby-buildpack/src/ruby/versions"
 	"github.com/kr/text"
 )
 
@@ -31,15 +40,17 @@ type Manifest interface {
 type Installer interface {
 	InstallDependency(libbuildpack.Dependency, string) error
 	InstallOnlyVersion(string, string) error
+	FetchDependency(libbuildpack.Dependency, string) error
 }
 
 type Versions interface {
 	SetBundlerVersion(string)
 	GetBundlerVersion() string
-	CheckBundler2Compatibility() (bool, error)
+	CheckBundlerCompatibility(bundlerVersion string) (bool, error)
 	Engine() (string, error)
 	Version() (string, error)
 	JrubyVersion() (string, error)
+	TruffleRubyVersion() (string, error)
 	RubyEngineVersion() (string, error)
 	HasGemVersion(gem string, constraints ...string) (bool, error)
 	VersionConstraint(version string, constraints ...string) (bool, error)
@@ -67,15 +78,76 @@ type Cache interface {
 	Save() error
 }
 
+// FreeTDSConflictingGems maps gems that clash with tiny_tds at runtime to an
+// explanation of the clash.
+var FreeTDSConflictingGems = map[string]string{
+	"ruby-odbc":    "ruby-odbc loads the stack's unixODBC, whose FreeTDS driver can differ from the FreeTDS this buildpack supplies.",
+	"odbc_adapter": "odbc_adapter connects through ruby-odbc and the stack's unixODBC, which can load a different FreeTDS than tiny_tds.",
+	"dbd-odbc":     "dbd-odbc connects through ruby-odbc and the stack's unixODBC, which can load a different FreeTDS than tiny_tds.",
+}
+
+// RustExtensionGems lists gems whose native extensions are written in Rust
+// and so need cargo and rustc, which the stacks do not provide.
+var RustExtensionGems = []string{
+	"rb_sys",
+	"tiktoken_ruby",
+	"tokenizers",
+	"wasmtime",
+	"y-rb",
+	"blake3-rb",
+}
+
+// ManifestStacks returns the stacks the manifest has the named dependency
+// for. A manifest packaged for a single stack applies to that stack only.
+func ManifestStacks(manifest *libbuildpack.Manifest, name string) []string {
+	if manifest.Stack != "" {
+		return []string{manifest.Stack}
+	}
+	var stacks []string
+	seen := map[string]bool{}
+	for _, entry := range manifest.ManifestEntries {
+		if entry.Dependency.Name != name {
+			continue
+		}
+		for _, stack := range entry.CFStacks {
+			if !seen[stack] {
+				seen[stack] = true
+				stacks = append(stacks, stack)
+			}
+		}
+	}
+	return stacks
+}
+
+// CheckStack fails for a CF_STACK outside supported, the stacks the manifest
+// has a FreeTDS for, before any install can fail on it with a confusing path
+// error. Without a CF_STACK there is nothing to check.
+func CheckStack(supported []string) error {
+	stack := os.Getenv("CF_STACK")
+	if stack == "" {
+		return nil
+	}
+	for _, s := range supported {
+		if stack == s {
+			return nil
+		}
+	}
+	if len(supported) == 0 {
+		return fmt.Errorf("This buildpack does not support the %s stack, since its manifest has no FreeTDS for any stack.", stack)
+	}
+	return fmt.Errorf("This buildpack does not support the %s stack, only %s.\nPush your app to one of those stacks, e.g. cf push -s %s", stack, strings.Join(supported, ", "), supported[0])
+}
+
 type Supplier struct {
 	Stager            Stager
 	Manifest          Manifest
 	Installer         Installer
-	Log               *libbuildpack.Logger
+	Log               Logger
 	Versions          Versions
 	Cache             Cache
 	Command           Command
 	TempDir           TempDir
+	SupportedStacks   []string
 	cachedNeedsNode   bool
 	needsNode         bool
 	appHasGemfile     bool
@@ -83,10 +155,26 @@ type Supplier struct {
 }
 
 func Run(s *Supplier) error {
+	if reporter, ok := s.Log.(interface{ ReportAdvisories() }); ok {
+		defer reporter.ReportAdvisories()
+	}
+
+	if err := CheckStack(s.SupportedStacks); err != nil {
+		s.Log.Error("%s", err.Error())
+		return err
+	}
+
+	if dryRun() {
+		return s.DryRun()
+	}
+
+	timer := NewStepTimer()
+	timer.Start("FreeTDS")
 	s.Log.BeginStep("Supplying FreeTDS")
 
-	freetds, err := s.Manifest.DefaultVersion("freetds")
+	freetds, err := s.FreeTDSDependency()
 	if err != nil {
+		s.Log.Error("Unable to determine FreeTDS version: %s", err.Error())
 		return err
 	}
 
@@ -95,28 +183,52 @@ func Run(s *Supplier) error {
 		return err
 	}
 
-	if err := s.Stager.WriteProfileD("finalize_freetds.sh", `#!/bin/bash
-# https://github.com/rails-sqlserver/tiny_tds/blob/master/ext/tiny_tds/extconf.rb#L38
-export FREETDS_DIR="$( cd /home/vcap/deps/*/freetds && pwd )"
+	if err := s.SmokeTestFreeTDS(); err != nil {
+		s.Log.Error("%s", err.Error())
+		return err
+	}
+
+	s.CheckFreeTDSTLS()
+
+	if err := s.CheckFreeTDSDirs(); err != nil {
+		s.Log.Error("Unable to find FreeTDS: %s", err.Error())
+		return err
+	}
+
+	if err := s.InstallLibiconv(); err != nil {
+		s.Log.Error("Unable to install libiconv: %s", err.Error())
+		return err
+	}
+
+	if err := s.SetStagingLibPaths(); err != nil {
+		s.Log.Error("Unable to set library paths: %s", err.Error())
+		return err
+	}
+
+	if err := s.CheckFreeTDSLibraries(); err != nil {
+		s.Log.Error("%s", err.Error())
+		return err
+	}
 
-# https://www.freetds.org/faq.html#SYBASE
-export SYBASE=$FREETDS_DIR
+	if err := s.WriteFreeTDSConf(); err != nil {
+		s.Log.Error("Unable to write freetds.conf: %s", err.Error())
+		return err
+	}
 
-# https://github.com/rails-sqlserver/heroku-buildpack-freetds/blob/master/bin/compile#L90
-export LD_LIBRARY_PATH="${FREETDS_DIR}/lib:${LD_LIBRARY_PATH:-/usr/local/lib}"
-export LD_RUN_PATH="${FREETDS_DIR}/lib:${LD_RUN_PATH:-/usr/local/lib}"
-export LIBRARY_PATH="${FREETDS_DIR}/lib:${LIBRARY_PATH:-/usr/local/lib}"
-`); err != nil {
+	if err := s.WriteFreeTDSProfileD(); err != nil {
 		s.Log.Error("Unable to write profile.d: %s", err.Error())
 		return err
 	}
 
+	timer.Start("Ruby")
 	s.Log.BeginStep("Supplying Ruby")
 
 	_ = s.Command.Execute(s.Stager.BuildDir(), ioutil.Discard, ioutil.Discard, "touch", "/tmp/checkpoint")
 
-	if checksum, err := s.CalcChecksum(); err == nil {
-		s.Log.Debug("BuildDir Checksum Before Supply: %s", checksum)
+	if DebugEnabled(s.Log) {
+		if checksum, err := s.CalcChecksum(); err == nil {
+			s.Log.Debug("BuildDir Checksum Before Supply: %s", checksum)
+		}
 	}
 
 	if err := s.Setup(); err != nil {
@@ -124,7 +236,7 @@ export LIBRARY_PATH="${FREETDS_DIR}/lib:${LIBRARY_PATH:-/usr/local/lib}"
 		return err
 	}
 
-	if err := s.Cache.Restore(); err != nil {
+	if err := s.RestoreCache(); err != nil {
 		s.Log.Error("Unable to restore cache: %s", err.Error())
 		return err
 	}
@@ -149,6 +261,19 @@ export LIBRARY_PATH="${FREETDS_DIR}/lib:${LIBRARY_PATH:-/usr/local/lib}"
 		s.Log.Error("Unable to determine ruby: %s", err.Error())
 		return err
 	}
+	s.WarnRubyEndOfLife(engine, rubyVersion, time.Now())
+
+	if err := s.InvalidateCachedGems(engine, rubyVersion); err != nil {
+		s.Log.Error("Unable to invalidate cached gems: %s", err.Error())
+		return err
+	}
+
+	if os.Getenv("BP_PREFETCH_DEPENDENCIES") == "true" {
+		if err := s.PrefetchDependencies(engine, rubyVersion); err != nil {
+			s.Log.Error("Unable to fetch dependencies: %s", err.Error())
+			return err
+		}
+	}
 
 	if engine == "jruby" {
 		if err = s.InstallJVM(); err != nil {
@@ -162,6 +287,11 @@ export LIBRARY_PATH="${FREETDS_DIR}/lib:${LIBRARY_PATH:-/usr/local/lib}"
 		return err
 	}
 
+	if err := s.WriteRubyVersionFile(engine, rubyVersion); err != nil {
+		s.Log.Error("Unable to write .ruby-version: %s", err.Error())
+		return err
+	}
+
 	if err := s.AddPostRubyInstallDefaultEnv(engine); err != nil {
 		s.Log.Error("Unable to add bundler and gem path to default environment: %s", err.Error())
 		return err
@@ -173,38 +303,92 @@ export LIBRARY_PATH="${FREETDS_DIR}/lib:${LIBRARY_PATH:-/usr/local/lib}"
 	}
 
 	if s.NeedsNode() {
+		timer.Start("Node")
 		if err := s.InstallNode(); err != nil {
 			s.Log.Error("Unable to install node: %s", err.Error())
 			return err
 		}
 
+		timer.Start("Yarn and pnpm")
 		if err := s.InstallYarn(); err != nil {
 			s.Log.Error("Unable to install yarn: %s", err.Error())
 			return err
 		}
+
+		if err := s.InstallPnpm(); err != nil {
+			s.Log.Error("Unable to install pnpm: %s", err.Error())
+			return err
+		}
+
+		timer.Start("Node modules")
+		if err := s.InstallNodeModules(); err != nil {
+			s.Log.Error("Unable to install node modules: %s", err.Error())
+			return err
+		}
+	}
+
+	if s.NeedsUnixODBC() {
+		timer.Start("unixODBC")
+		if err := s.WriteODBCInstIni(); err != nil {
+			s.Log.Error("Unable to declare the FreeTDS ODBC driver: %s", err.Error())
+			return err
+		}
+
+		if err := s.InstallUnixODBC(); err != nil {
+			s.Log.Error("Unable to install unixODBC: %s", err.Error())
+			return err
+		}
 	}
 
+	timer.Start("Gems")
 	if err := s.InstallGems(); err != nil {
 		s.Log.Error("Unable to install gems: %s", err.Error())
 		return err
 	}
 
+	timer.Start("Finishing")
+
 	if err := s.RewriteShebangs(); err != nil {
 		s.Log.Error("Unable to rewrite shebangs: %s", err.Error())
 		return err
 	}
 
+	if err := s.StripGitDirs(); err != nil {
+		s.Log.Error("Unable to strip .git from git-sourced gems: %s", err.Error())
+		return err
+	}
+
 	if err := s.SymlinkBundlerIntoRubygems(); err != nil {
 		s.Log.Error("Unable to symlink bundler into rubygems: %s", err.Error())
 		return err
 	}
 
+	if err := s.CreateConvenienceSymlinks(); err != nil {
+		s.Log.Error("Unable to create convenience symlinks: %s", err.Error())
+		return err
+	}
+
+	if err := s.PrecompileAssets(); err != nil {
+		s.Log.Error("Unable to precompile assets: %s", err.Error())
+		return err
+	}
+
 	if err := s.WriteProfileD(engine); err != nil {
 		s.Log.Error("Unable to write profile.d: %s", err.Error())
 		return err
 	}
 
-	if err := s.Cache.Save(); err != nil {
+	if err := s.ValidateAppProfileD(); err != nil {
+		s.Log.Error("Unable to validate the app's profile.d scripts: %s", err.Error())
+		return err
+	}
+
+	if err := s.WriteDecisions(engine, rubyVersion); err != nil {
+		s.Log.Error("Unable to write staging decisions: %s", err.Error())
+		return err
+	}
+
+	if err := s.SaveCache(); err != nil {
 		s.Log.Error("Unable to save cache: %s", err.Error())
 		return err
 	}
@@ -214,25 +398,61 @@ export LIBRARY_PATH="${FREETDS_DIR}/lib:${LIBRARY_PATH:-/usr/local/lib}"
 		return err
 	}
 
-	if checksum, err := s.CalcChecksum(); err == nil {
-		s.Log.Debug("BuildDir Checksum After Supply: %s", checksum)
+	if DebugEnabled(s.Log) {
+		if checksum, err := s.CalcChecksum(); err == nil {
+			s.Log.Debug("BuildDir Checksum After Supply: %s", checksum)
+		}
 	}
 
 	if filesChanged, err := s.Command.Output(s.Stager.BuildDir(), "find", ".", "-newer", "/tmp/checkpoint", "-not", "-path", "./.cloudfoundry/*", "-not", "-path", "./.cloudfoundry"); err == nil && filesChanged != "" {
 		s.Log.Debug("Below files changed:")
-		s.Log.Debug(filesChanged)
+		s.Log.Debug("%s", filesChanged)
+	}
+
+	timer.Report(s.Log)
+	return nil
+}
+
+// RestoreCache and SaveCache only fail staging when BP_STRICT_CACHE=true.
+// Otherwise a read-only or missing cache volume is logged and the app is
+// staged without the cache.
+func (s *Supplier) RestoreCache() error {
+	if err := s.Cache.Restore(); err != nil {
+		if os.Getenv("BP_STRICT_CACHE") == "true" {
+			return err
+		}
+		s.Log.Warning("Unable to restore cache, continuing without it: %s", err.Error())
+	}
+	return nil
+}
+
+func (s *Supplier) SaveCache() error {
+	if err := s.Cache.Save(); err != nil {
+		if os.Getenv("BP_STRICT_CACHE") == "true" {
+			return err
+		}
+		s.Log.Warning("Unable to save cache, the next staging will not be able to use it: %s", err.Error())
 	}
 	return nil
 }
 
 func (s *Supplier) Setup() error {
+	if err := s.detectGemsRb(); err != nil {
+		return err
+	}
+
+	return s.detectGemfile()
+}
+
+// detectGemfile records whether the app has a Gemfile and a Gemfile.lock.
+func (s *Supplier) detectGemfile() error {
 	if exists, err := libbuildpack.FileExists(s.Versions.Gemfile()); err != nil {
 		return fmt.Errorf("unable to determine if Gemfile exists: %v", err)
 	} else {
 		s.appHasGemfile = exists
 	}
 
-	if exists, err := libbuildpack.FileExists(fmt.Sprintf("%s.lock", s.Versions.Gemfile())); err != nil {
+	if exists, err := libbuildpack.FileExists(versions.GemfileLock(s.Versions.Gemfile())); err != nil {
 		return fmt.Errorf("Unable to determine if Gemfile.lock exists: %v", err)
 	} else {
 		s.appHasGemfileLock = exists
@@ -241,13 +461,77 @@ func (s *Supplier) Setup() error {
 	return nil
 }
 
+// detectGemsRb exports BUNDLE_GEMFILE=gems.rb for apps that use bundler's
+// gems.rb and gems.locked rather than a Gemfile, unless BUNDLE_GEMFILE is
+// already set. An app with both keeps using its Gemfile, as bundler does.
+func (s *Supplier) detectGemsRb() error {
+	if os.Getenv("BUNDLE_GEMFILE") != "" {
+		return nil
+	}
+	hasGemsRb, err := libbuildpack.FileExists(filepath.Join(s.Stager.BuildDir(), versions.GemsRb))
+	if err != nil || !hasGemsRb {
+		return err
+	}
+	hasGemfile, err := libbuildpack.FileExists(filepath.Join(s.Stager.BuildDir(), "Gemfile"))
+	if err != nil {
+		return err
+	}
+	if hasGemfile {
+		s.Log.Warning("Your app has both a Gemfile and a gems.rb, so the Gemfile is used.\nRemove one of them, or set BUNDLE_GEMFILE=gems.rb to use gems.rb.")
+		return nil
+	}
+	return s.writeEnvFiles(map[string]string{"BUNDLE_GEMFILE": versions.GemsRb}, false)
+}
+
+// DetermineRuby returns the engine and version of ruby to install. When the
+// app asks for a ruby the manifest does not have, the available versions are
+// logged so the user can pick one.
 func (s *Supplier) DetermineRuby() (string, string, error) {
+	engine, version, err := s.determineRuby()
+	if errors.Is(err, versions.ErrUnavailableRuby) {
+		s.logAvailableRubyVersions()
+	}
+	return engine, version, err
+}
+
+func (s *Supplier) logAvailableRubyVersions() {
+	var versions []*semver.Version
+	for _, v := range s.Manifest.AllDependencyVersions("ruby") {
+		if version, err := semver.NewVersion(v); err == nil {
+			versions = append(versions, version)
+		}
+	}
+	sort.Sort(semver.Collection(versions))
+
+	available := make([]string, len(versions))
+	for i, version := range versions {
+		available[i] = version.Original()
+	}
+	s.Log.Error("This buildpack provides ruby %s\nSet one of these in your Gemfile, or a version constraint such as ~> 3.1 that matches one.", strings.Join(available, ", "))
+}
+
+func (s *Supplier) determineRuby() (string, string, error) {
+	if scriptVersion, err := s.rubyVersionFromScript(); err != nil {
+		return "", "", err
+	} else if scriptVersion != "" {
+		s.Log.Info("Using ruby %s from bin/cf_ruby_version", scriptVersion)
+		return "ruby", scriptVersion, nil
+	}
+
 	if !s.appHasGemfile {
-		dep, err := s.Manifest.DefaultVersion("ruby")
+		version, source, err := s.undeclaredRubyVersion()
 		if err != nil {
-			return "", "", fmt.Errorf("unable to determine default ruby version: %v", err)
+			return "", "", err
 		}
-		return "ruby", dep.Version, nil
+		if version == "" {
+			dep, err := s.Manifest.DefaultVersion("ruby")
+			if err != nil {
+				return "", "", fmt.Errorf("unable to determine default ruby version: %v", err)
+			}
+			version, source = dep.Version, "the manifest default"
+		}
+		s.Log.Debug("Ruby version %s determined by %s", version, source)
+		return "ruby", version, nil
 	}
 
 	engine, err := s.Versions.Engine()
@@ -255,462 +539,1346 @@ func (s *Supplier) DetermineRuby() (string, string, error) {
 		return "", "", fmt.Errorf("unable to determine ruby engine: %v", err)
 	}
 
+	// Engine is ruby for a Gemfile without a ruby directive too, which only
+	// an empty Version tells apart from one that asks for MRI.
 	var rubyVersion string
 	if engine == "ruby" {
 		rubyVersion, err = s.Versions.Version()
 		if err != nil {
-			return "", "", fmt.Errorf("Unable to determine ruby version: %v", err)
+			return "", "", fmt.Errorf("Unable to determine ruby version: %w", err)
+		}
+	}
+
+	if jrubyVersion, source, err := s.jrubyVersionFile(); err != nil {
+		return "", "", err
+	} else if jrubyVersion != "" && engine == "ruby" && rubyVersion == "" {
+		s.Log.Info("Ignoring %s, since the Gemfile does not declare a ruby engine. Add a ruby directive with engine: 'jruby' to the Gemfile to use jruby.", source)
+	} else if jrubyVersion != "" && engine != "jruby" {
+		if useJruby, err := s.resolveEngineConflict(engine, jrubyVersion, source); err != nil {
+			return "", "", err
+		} else if useJruby {
+			version, err := s.matchJrubyVersion(jrubyVersion, source)
+			if err != nil {
+				return "", "", err
+			}
+			return "jruby", version, nil
+		}
+	}
+
+	if engine == "ruby" {
+		source := "the Gemfile"
+		if rubyVersion == "" {
+			if rubyVersion, source, err = s.undeclaredRubyVersion(); err != nil {
+				return "", "", err
+			}
+		} else {
+			s.warnRubyVersionFileConflict(rubyVersion)
 		}
 		if rubyVersion == "" {
 			if dep, err := s.Manifest.DefaultVersion("ruby"); err != nil {
 				return "", "", fmt.Errorf("Unable to determine ruby version: %v", err)
 			} else {
-				rubyVersion = dep.Version
+				rubyVersion, source = dep.Version, "the manifest default"
 				s.Log.Warning("You have not declared a Ruby version in your Gemfile.\nDefaulting to %s\nSee http://docs.cloudfoundry.org/buildpacks/ruby/index.html#runtime for more information.", rubyVersion)
 			}
 		}
+		s.Log.Debug("Ruby version %s determined by %s", rubyVersion, source)
 	} else if engine == "jruby" {
 		rubyVersion, err = s.Versions.JrubyVersion()
 		if err != nil {
 			return "", "", fmt.Errorf("Unable to determine jruby version: %v", err)
 		}
+	} else if engine == "truffleruby" {
+		rubyVersion, err = s.truffleRubyVersion()
+		if err != nil {
+			return "", "", err
+		}
 	} else {
 		return "", "", fmt.Errorf("Sorry, we do not support engine: %s", engine)
 	}
 	return engine, rubyVersion, nil
 }
 
-func (s *Supplier) InstallYarn() error {
-	exists, err := libbuildpack.FileExists(filepath.Join(s.Stager.BuildDir(), "yarn.lock"))
+// truffleRubyVersion resolves the Gemfile's truffleruby engine_version
+// against the manifest, using the newest truffleruby when it names none.
+func (s *Supplier) truffleRubyVersion() (string, error) {
+	versions := s.Manifest.AllDependencyVersions("truffleruby")
+	if len(versions) == 0 {
+		return "", fmt.Errorf("Your Gemfile asks for truffleruby, which is not available on this stack (%s)", os.Getenv("CF_STACK"))
+	}
+
+	requested, err := s.Versions.TruffleRubyVersion()
 	if err != nil {
-		return err
+		return "", fmt.Errorf("Unable to determine truffleruby version: %v", err)
 	}
-	if !exists {
-		return nil
+	if requested == "" {
+		requested = "x"
 	}
 
-	tempDir, err := ioutil.TempDir("", "yarn")
+	version, err := libbuildpack.FindMatchingVersion(requested, versions)
 	if err != nil {
-		return err
-	}
-	if err := s.Installer.InstallOnlyVersion("yarn", tempDir); err != nil {
-		return err
+		return "", fmt.Errorf("Your Gemfile asks for truffleruby %s, which this buildpack does not provide (available: %s)", requested, strings.Join(versions, ", "))
 	}
-	if paths, err := filepath.Glob(filepath.Join(tempDir, "yarn-v*")); err != nil {
-		return err
-	} else if len(paths) != 1 {
-		return fmt.Errorf("Unable to find yarn distribution dir")
-	} else {
-		tempDir = paths[0]
+	return version, nil
+}
+
+// jrubyVersionFile returns the jruby version named by .jruby-version, or by
+// a .ruby-version of the form jruby-<version>, along with the file it came
+// from. Both are empty when neither file asks for jruby.
+func (s *Supplier) jrubyVersionFile() (string, string, error) {
+	for _, name := range []string{".jruby-version", ".ruby-version"} {
+		body, err := ioutil.ReadFile(filepath.Join(s.Stager.BuildDir(), name))
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return "", "", err
+		}
+
+		version := strings.TrimSpace(string(body))
+		if name == ".ruby-version" && !strings.HasPrefix(version, "jruby-") {
+			continue
+		}
+		if version = strings.TrimPrefix(version, "jruby-"); version != "" {
+			return version, name, nil
+		}
 	}
+	return "", "", nil
+}
 
-	if err := os.Rename(tempDir, filepath.Join(s.Stager.DepDir(), "yarn")); err != nil {
-		return err
+// matchJrubyVersion checks the version a jruby version file asks for against
+// the manifest's jruby versions. jruby versions have four parts, which are not
+// semver, so only an exact version matches.
+func (s *Supplier) matchJrubyVersion(requested, source string) (string, error) {
+	versions := s.Manifest.AllDependencyVersions("jruby")
+	for _, version := range versions {
+		if version == requested {
+			return version, nil
+		}
 	}
-	return s.Stager.LinkDirectoryInDepDir(filepath.Join(s.Stager.DepDir(), "yarn", "bin"), "bin")
+	return "", fmt.Errorf("%s asks for jruby %s, which this buildpack does not provide (available: %s)", source, requested, strings.Join(versions, ", "))
 }
 
-func (s *Supplier) InstallBundler() error {
-	bundlerOneVersion, err := s.installBundlerOne()
-	if err != nil {
-		return err
+// resolveEngineConflict decides between the Gemfile's engine and a jruby
+// version file according to BP_ENGINE_CONFLICT: prefer-gemfile (the default),
+// prefer-jruby, or fail. It returns true when jruby should be used.
+func (s *Supplier) resolveEngineConflict(gemfileEngine, jrubyVersion, source string) (bool, error) {
+	conflict := fmt.Sprintf("Your Gemfile asks for %s, but %s asks for jruby %s", gemfileEngine, source, jrubyVersion)
+
+	switch resolution := os.Getenv("BP_ENGINE_CONFLICT"); resolution {
+	case "", "prefer-gemfile":
+		s.Log.Warning("%s.\nUsing %s from the Gemfile. Set BP_ENGINE_CONFLICT=prefer-jruby to use jruby instead.", conflict, gemfileEngine)
+		return false, nil
+	case "prefer-jruby":
+		s.Log.Warning("%s.\nUsing jruby %s from %s since BP_ENGINE_CONFLICT=prefer-jruby.", conflict, jrubyVersion, source)
+		return true, nil
+	case "fail":
+		return false, fmt.Errorf("%s, and BP_ENGINE_CONFLICT=fail", conflict)
+	default:
+		return false, fmt.Errorf("BP_ENGINE_CONFLICT must be prefer-gemfile, prefer-jruby or fail, not %s", resolution)
 	}
-	s.Versions.SetBundlerVersion(bundlerOneVersion)
+}
 
-	if !s.appHasGemfile {
-		return nil
+func (s *Supplier) rubyVersionScript() string {
+	return filepath.Join(s.Stager.BuildDir(), "bin", "cf_ruby_version")
+}
+
+// rubyVersionFromScript runs an executable bin/cf_ruby_version in the app, for
+// organizations that compute the ruby version from a central policy. The
+// version it prints takes precedence over every other source.
+func (s *Supplier) rubyVersionFromScript() (string, error) {
+	script := s.rubyVersionScript()
+	if info, err := os.Stat(script); os.IsNotExist(err) {
+		return "", nil
+	} else if err != nil {
+		return "", err
+	} else if info.Mode()&0111 == 0 {
+		s.Log.Warning("Ignoring bin/cf_ruby_version because it is not executable")
+		return "", nil
 	}
 
-	bundlerTwoVersion, err := s.installBundlerTwo()
+	output, err := s.Command.Output(s.Stager.BuildDir(), script)
 	if err != nil {
-		return err
+		return "", fmt.Errorf("bin/cf_ruby_version failed: %v", err)
 	}
-	s.Versions.SetBundlerVersion(bundlerTwoVersion)
 
-	if ok, err := s.Versions.CheckBundler2Compatibility(); err != nil {
-		return err
-	} else if ok {
-		return nil
+	requested := strings.TrimSpace(output)
+	if requested == "" {
+		return "", fmt.Errorf("bin/cf_ruby_version did not print a ruby version")
 	}
 
-	s.Log.Warning("Ruby version not compatible with Bundler 2")
-	s.Versions.SetBundlerVersion(bundlerOneVersion)
-	return s.uninstallBundlerTwo()
+	version, err := libbuildpack.FindMatchingVersion(requested, s.Manifest.AllDependencyVersions("ruby"))
+	if err != nil {
+		return "", fmt.Errorf("bin/cf_ruby_version printed %s, which %w: %v", requested, versions.ErrUnavailableRuby, err)
+	}
+	return version, nil
 }
 
-func (s *Supplier) InstallNode() error {
-	var dep libbuildpack.Dependency
+var rubyVersionFilePattern = regexp.MustCompile(`^(?:ruby-)?(\d+\.\d+(?:\.\d+)?)$`)
 
-	tempDir, err := ioutil.TempDir("", "node")
-	if err != nil {
-		return err
+// rubyVersionFile resolves the version in the app's .ruby-version. It is
+// empty when there is no such file, or when it asks for jruby (see
+// jrubyVersionFile).
+func (s *Supplier) rubyVersionFile() (string, error) {
+	body, err := ioutil.ReadFile(filepath.Join(s.Stager.BuildDir(), ".ruby-version"))
+	if os.IsNotExist(err) {
+		return "", nil
+	} else if err != nil {
+		return "", err
 	}
-	nodeInstallDir := filepath.Join(s.Stager.DepDir(), "node")
 
-	version, err := libbuildpack.FindMatchingVersion("x", s.Manifest.AllDependencyVersions("node"))
-	if err != nil {
-		return err
+	contents := strings.TrimSpace(string(body))
+	if strings.HasPrefix(contents, "jruby-") {
+		return "", nil
 	}
-	dep.Name = "node"
-	dep.Version = version
+	return s.matchRubyVersion(contents, ".ruby-version")
+}
 
-	if err := s.Installer.InstallDependency(dep, tempDir); err != nil {
-		return err
+// rubyToolVersion resolves the ruby line of .tool-versions, ignoring the
+// jruby-<version> form that asdf also accepts there.
+func (s *Supplier) rubyToolVersion() (string, error) {
+	requested, err := s.toolVersion("ruby")
+	if err != nil || requested == "" {
+		return "", err
 	}
+	if strings.HasPrefix(requested, "jruby-") {
+		s.Log.Debug("Ignoring ruby %s from %s, since only the Gemfile or .jruby-version can choose jruby", requested, ToolVersionsFile)
+		return "", nil
+	}
+	return s.matchRubyVersion(requested, ToolVersionsFile)
+}
 
-	if err := os.Rename(filepath.Join(tempDir, fmt.Sprintf("node-v%s-linux-x64", dep.Version)), nodeInstallDir); err != nil {
-		return err
+// matchRubyVersion resolves a ruby-x.y.z or bare x.y.z version from source
+// against the manifest, where x.y matches any patch.
+func (s *Supplier) matchRubyVersion(requested, source string) (string, error) {
+	match := rubyVersionFilePattern.FindStringSubmatch(requested)
+	if match == nil {
+		return "", fmt.Errorf("%s contains %q, expected a ruby version such as 2.6.3 or ruby-2.6.3", source, requested)
 	}
 
-	return s.Stager.LinkDirectoryInDepDir(filepath.Join(nodeInstallDir, "bin"), "bin")
+	constraint := match[1]
+	if strings.Count(constraint, ".") == 1 {
+		constraint += ".x"
+	}
+	version, err := libbuildpack.FindMatchingVersion(constraint, s.Manifest.AllDependencyVersions("ruby"))
+	if err != nil {
+		return "", fmt.Errorf("%s asks for ruby %s, which %w: %v", source, match[1], versions.ErrUnavailableRuby, err)
+	}
+	return version, nil
 }
 
-func (s *Supplier) NeedsNode() bool {
-	if s.cachedNeedsNode {
-		return s.needsNode
+// rubyVersionSources are where the ruby version comes from, highest
+// precedence first.
+var rubyVersionSources = []string{"bin/cf_ruby_version", "the Gemfile", ".ruby-version", ToolVersionsFile, "RUBY_VERSION_OVERRIDE"}
+
+// warnRubyVersionFileConflict warns when .ruby-version asks for a different
+// ruby than the Gemfile, whose version is used, so an edited .ruby-version is
+// not silently ignored.
+func (s *Supplier) warnRubyVersionFileConflict(gemfileVersion string) {
+	fileVersion, err := s.rubyVersionFile()
+	if err != nil {
+		s.Log.Debug("Not comparing .ruby-version with the Gemfile: %v", err)
+		return
 	}
-	s.cachedNeedsNode = true
-	s.needsNode = false
+	if fileVersion == "" || fileVersion == gemfileVersion {
+		return
+	}
+	s.Log.Warning("Your Gemfile asks for ruby %s but .ruby-version asks for ruby %s, so ruby %s from the Gemfile is used.\nUpdate one of them so they agree.", gemfileVersion, fileVersion, gemfileVersion)
+	s.Log.Info("The ruby version is taken from the first of these that sets one: %s", strings.Join(rubyVersionSources, ", "))
+}
 
-	if s.isNodeInstalled() {
-		s.Log.BeginStep("Skipping install of nodejs since it has been supplied")
-	} else {
-		for _, name := range []string{"webpacker", "execjs"} {
-			s.Log.Debug("Test %s in gemfile", name)
-			hasgem, err := s.Versions.HasGemVersion(name, ">=0.0.0")
-			if err == nil && hasgem {
-				s.Log.Debug("Found %s in gemfile", name)
-				s.needsNode = true
-				break
-			}
+// undeclaredRubyVersion picks a ruby for an app whose Gemfile does not pin
+// one, from .ruby-version, then .tool-versions, then RUBY_VERSION_OVERRIDE,
+// returning the version and where it came from. Both are empty when none of
+// them name a ruby.
+func (s *Supplier) undeclaredRubyVersion() (string, string, error) {
+	sources := []struct {
+		name    string
+		resolve func() (string, error)
+	}{
+		{".ruby-version", s.rubyVersionFile},
+		{ToolVersionsFile, s.rubyToolVersion},
+		{"RUBY_VERSION_OVERRIDE", s.rubyVersionOverride},
+	}
+	for _, source := range sources {
+		version, err := source.resolve()
+		if err != nil {
+			return "", "", err
+		} else if version != "" {
+			s.Log.Info("Using ruby %s from %s", version, source.name)
+			return version, source.name, nil
 		}
 	}
-
-	return s.needsNode
+	return "", "", nil
 }
 
-func (s *Supplier) isNodeInstalled() bool {
-	_, err := s.Command.Output(s.Stager.BuildDir(), "node", "--version")
-	return err == nil
+// rubyVersionOverride resolves RUBY_VERSION_OVERRIDE, which upstream
+// buildpacks may set to choose a ruby when the app does not declare one.
+func (s *Supplier) rubyVersionOverride() (string, error) {
+	constraint := os.Getenv("RUBY_VERSION_OVERRIDE")
+	if constraint == "" {
+		return "", nil
+	}
+
+	version, err := libbuildpack.FindMatchingVersion(constraint, s.Manifest.AllDependencyVersions("ruby"))
+	if err != nil {
+		return "", fmt.Errorf("RUBY_VERSION_OVERRIDE %s %w: %v", constraint, versions.ErrUnavailableRuby, err)
+	}
+	return version, nil
 }
 
-func (s *Supplier) InstallJVM() error {
-	if exists, err := libbuildpack.FileExists(filepath.Join(s.Stager.BuildDir(), ".jdk")); err != nil {
-		return err
-	} else if exists {
-		s.Log.Info("Using pre-installed JDK")
+func (s *Supplier) InstallYarn() error {
+	if nodeInstallDisabled() {
 		return nil
 	}
 
-	jvmInstallDir := filepath.Join(s.Stager.DepDir(), "jvm")
-	if err := s.Installer.InstallOnlyVersion("openjdk1.8-latest", jvmInstallDir); err != nil {
+	exists, err := libbuildpack.FileExists(filepath.Join(s.Stager.BuildDir(), "yarn.lock"))
+	if err != nil {
 		return err
 	}
-	if err := s.Stager.LinkDirectoryInDepDir(filepath.Join(jvmInstallDir, "bin"), "bin"); err != nil {
-		return err
+	if !exists {
+		return nil
 	}
-
-	scriptContents := `
-if ! [[ "${JAVA_OPTS}" == *-Xmx* ]]; then
-  export JAVA_MEM=${JAVA_MEM:--Xmx${JVM_MAX_HEAP:-384}m}
-fi
-export JAVA_OPTS=${JAVA_OPTS:--Xss512k -XX:+UseCompressedOops -Dfile.encoding=UTF-8}
-export JRUBY_OPTS=${JRUBY_OPTS:--Xcompile.invokedynamic=false}
-`
-
-	return s.Stager.WriteProfileD("jruby.sh", scriptContents)
-}
-
-func (s *Supplier) InstallRuby(name, version string) error {
-	installDir := filepath.Join(s.Stager.DepDir(), "ruby")
-
-	if err := s.Installer.InstallDependency(libbuildpack.Dependency{Name: name, Version: version}, installDir); err != nil {
+	if usesPnpm, err := s.usesPnpm(); err != nil {
 		return err
+	} else if usesPnpm {
+		s.Log.Debug("Not installing yarn, since the app has a %s", pnpmLockfile)
+		return nil
 	}
 
-	if err := s.RewriteShebangs(); err != nil {
+	yarnPath, err := s.yarnBerryPath()
+	if err != nil {
 		return err
 	}
-
-	if err := os.Symlink("ruby", filepath.Join(s.Stager.DepDir(), "ruby", "bin", "ruby.exe")); err != nil {
-		return err
+	if yarnPath != "" {
+		s.Log.Info("Using yarn berry from %s, bootstrapped by the buildpack's yarn", yarnPath)
+	} else {
+		s.Log.Info("Using yarn classic")
 	}
 
-	return s.Stager.LinkDirectoryInDepDir(filepath.Join(s.Stager.DepDir(), "ruby", "bin"), "bin")
-}
-
-func (s *Supplier) RewriteShebangs() error {
-	files1, err := filepath.Glob(filepath.Join(s.Stager.DepDir(), "bin", "*"))
+	tempDir, err := ioutil.TempDir("", "yarn")
 	if err != nil {
 		return err
 	}
-	files2, err := filepath.Glob(filepath.Join(s.Stager.DepDir(), "vendor_bundle", "ruby", "*", "bin", "*"))
+	if err := s.Installer.InstallOnlyVersion("yarn", tempDir); err != nil {
+		return err
+	}
+	distDir, err := yarnDistDir(tempDir)
 	if err != nil {
 		return err
 	}
 
-	for _, file := range append(files1, files2...) {
-		if fileInfo, err := os.Stat(file); err != nil {
-			return err
-		} else if fileInfo.IsDir() {
-			continue
-		}
-		fileContents, err := ioutil.ReadFile(file)
-		if err != nil {
-			return err
-		}
-		shebangRegex := regexp.MustCompile(`^#!/.*/ruby.*`)
-		fileContents = shebangRegex.ReplaceAll(fileContents, []byte("#!/usr/bin/env ruby"))
-		if err := ioutil.WriteFile(file, fileContents, 0755); err != nil {
-			return err
-		}
+	if err := os.Rename(distDir, filepath.Join(s.Stager.DepDir(), "yarn")); err != nil {
+		return err
 	}
-	return nil
+	return s.Stager.LinkDirectoryInDepDir(filepath.Join(s.Stager.DepDir(), "yarn", "bin"), "bin")
 }
 
-func (s *Supplier) SymlinkBundlerIntoRubygems() error {
-	s.Log.Debug("SymlinkBundlerIntoRubygems")
-
-	rubyEngineVersion, err := s.Versions.RubyEngineVersion()
+// yarnDistDir finds the yarn distribution in dir: the single yarn-v* dir the
+// classic tarball unpacks to, or dir itself when it holds bin/yarn.
+func yarnDistDir(dir string) (string, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "yarn-v*"))
 	if err != nil {
-		return fmt.Errorf("Unable to determine ruby engine: %s", err)
+		return "", err
+	} else if len(paths) == 1 {
+		return paths[0], nil
+	}
+	if exists, err := libbuildpack.FileExists(filepath.Join(dir, "bin", "yarn")); err != nil {
+		return "", err
+	} else if exists {
+		return dir, nil
 	}
+	return "", fmt.Errorf("Unable to find yarn distribution dir, found %d yarn-v* dirs", len(paths))
+}
 
-	bundlerVersion := s.Versions.GetBundlerVersion()
+// pnpmLockfile marks an app whose node modules are managed by pnpm. It
+// takes precedence over a yarn.lock.
+const pnpmLockfile = "pnpm-lock.yaml"
 
-	destDir := filepath.Join(s.Stager.DepDir(), "ruby", "lib", "ruby", "gems", rubyEngineVersion, "gems")
-	if err := os.MkdirAll(destDir, 0755); err != nil {
-		return err
+// usesPnpm reports whether the app has a pnpm-lock.yaml and the manifest has
+// a pnpm to install for it. Without a pnpm the app falls back to yarn.
+func (s *Supplier) usesPnpm() (bool, error) {
+	if exists, err := libbuildpack.FileExists(filepath.Join(s.Stager.BuildDir(), pnpmLockfile)); err != nil || !exists {
+		return false, err
 	}
-	srcDir := filepath.Join(s.Stager.DepDir(), "bundler", "gems", "bundler-"+bundlerVersion)
-	relPath, err := filepath.Rel(destDir, srcDir)
-	if err != nil {
-		return err
+	return len(s.Manifest.AllDependencyVersions("pnpm")) > 0, nil
+}
+
+// InstallPnpm installs pnpm into the dep dir for apps with a pnpm-lock.yaml.
+func (s *Supplier) InstallPnpm() error {
+	if nodeInstallDisabled() {
+		return nil
 	}
 
-	destFile := filepath.Join(destDir, "bundler-"+bundlerVersion)
-	if found, err := libbuildpack.FileExists(destFile); err != nil {
+	if exists, err := libbuildpack.FileExists(filepath.Join(s.Stager.BuildDir(), pnpmLockfile)); err != nil {
 		return err
-	} else if found {
-		s.Log.Debug("Skipping linking bundler since destination exists")
+	} else if !exists {
 		return nil
 	}
-
-	return os.Symlink(relPath, destFile)
-}
-
-func (s *Supplier) UpdateRubygems() error {
-	dep := libbuildpack.Dependency{Name: "rubygems"}
-	versions := s.Manifest.AllDependencyVersions(dep.Name)
-	if len(versions) == 0 {
+	if usesPnpm, err := s.usesPnpm(); err != nil {
+		return err
+	} else if !usesPnpm {
+		s.Log.Warning("The app has a %s, but this buildpack does not provide pnpm, so it was not installed", pnpmLockfile)
 		return nil
-	} else if len(versions) > 1 {
-		return fmt.Errorf("Too many versions of rubygems in manifest")
 	}
-	dep.Version = versions[0]
 
-	currVersion, err := s.Command.Output("/", "gem", "--version")
+	pnpmDir := filepath.Join(s.Stager.DepDir(), "pnpm")
+	if err := s.Installer.InstallOnlyVersion("pnpm", pnpmDir); err != nil {
+		return err
+	}
+	return s.Stager.LinkDirectoryInDepDir(filepath.Join(pnpmDir, "bin"), "bin")
+}
+
+func (s *Supplier) InstallBundler() error {
+	bundlerOneVersion, err := s.installBundlerOne()
 	if err != nil {
-		return fmt.Errorf("Could not determine current version of rubygems: %v", err)
+		return err
 	}
+	s.Versions.SetBundlerVersion(bundlerOneVersion)
 
-	currVersion = strings.TrimSpace(currVersion)
-	if newer, err := s.Versions.VersionConstraint(currVersion, fmt.Sprintf(">= %s", dep.Version)); err != nil {
-		return fmt.Errorf("Could not parse rubygems version constraint: %s >= %s: %v", currVersion, dep.Version, err)
-	} else if newer {
+	if !s.appHasGemfile {
 		return nil
 	}
 
-	if engine, err := s.Versions.Engine(); err != nil {
+	if vendored, err := s.installVendoredBundler(bundlerOneVersion); err != nil {
 		return err
-	} else if engine == "jruby" {
-		s.Log.Debug("Skipping update of rubygems since jruby")
+	} else if vendored {
 		return nil
 	}
 
-	s.Log.BeginStep("Update rubygems from %s to %s", currVersion, dep.Version)
-
-	tempDir, err := ioutil.TempDir("", "rubygems")
-	if err != nil {
+	if err := s.checkBundledWithAvailable(); err != nil {
 		return err
 	}
 
-	if err := s.Installer.InstallDependency(dep, tempDir); err != nil {
+	bundlerTwoVersion, err := s.resolveBundlerVersion()
+	if err != nil {
 		return err
+	} else if bundlerTwoVersion == "" {
+		s.Log.Warning("Ruby version not compatible with Bundler 2")
+		s.Log.Info("Using bundler %s", bundlerOneVersion)
+		return nil
 	}
 
-	if err := os.MkdirAll(filepath.Join(s.Stager.DepDir(), "gem_home"), 0755); err != nil {
+	if err := s.installBundlerTwo(bundlerTwoVersion); err != nil {
 		return err
 	}
+	s.Versions.SetBundlerVersion(bundlerTwoVersion)
+	s.Log.Info("Using bundler %s", bundlerTwoVersion)
 
-	rubygemsDir := filepath.Join(tempDir, fmt.Sprintf("rubygems-%s", dep.Version))
-	if output, err := s.Command.Output(rubygemsDir, "ruby", "setup.rb"); err != nil {
-		s.Log.Error(output)
-		return fmt.Errorf("Could not install rubygems: %v", err)
+	if os.Getenv("BP_REMOVE_UNUSED_BUNDLER") == "true" {
+		s.Log.Debug("Removing unused bundler %s", bundlerOneVersion)
+		return s.uninstallBundlerOne(bundlerOneVersion)
 	}
-
 	return nil
 }
 
-type IndentedWriter struct {
-	w   io.Writer
-	pad string
-}
-
-func (w *IndentedWriter) Write(p []byte) (n int, err error) {
-	lines := strings.Split(string(p), "\n")
-	for i, line := range lines {
-		lines[i] = w.pad + line
-	}
-	p = []byte(strings.Join(lines, "\n"))
-	return w.Write(p)
-}
-
-type LinuxTempDir struct {
-	Log *libbuildpack.Logger
-}
+func (s *Supplier) InstallNode() error {
+	var dep libbuildpack.Dependency
 
-func (t *LinuxTempDir) CopyDirToTemp(dir string) (string, error) {
-	tempDir, err := ioutil.TempDir("", "app")
+	tempDir, err := ioutil.TempDir("", "node")
 	if err != nil {
-		return "", err
-	}
-	cmd := exec.Command("cp", "-al", dir, tempDir)
-	if output, err := cmd.CombinedOutput(); err != nil {
-		t.Log.Error(string(output))
-		return "", fmt.Errorf("Could not copy build dir to temp: %v", err)
-	}
-	tempDir = filepath.Join(tempDir, filepath.Base(dir))
-	return tempDir, nil
-}
-
-func (s *Supplier) InstallGems() error {
-	if !s.appHasGemfile {
-		return nil
+		return err
 	}
+	nodeInstallDir := filepath.Join(s.Stager.DepDir(), "node")
 
-	s.warnBundleConfig()
-	s.warnWindowsGemfile()
-
-	tempDir, err := s.TempDir.CopyDirToTemp(s.Stager.BuildDir())
-	if err != nil {
-		return nil
-	}
-	gemfileLock, err := filepath.Rel(s.Stager.BuildDir(), s.Versions.Gemfile())
+	version, err := s.nodeVersion()
 	if err != nil {
-		return nil
-	}
-	gemfileLock = fmt.Sprintf("%s.lock", filepath.Join(tempDir, gemfileLock))
-
-	if hasFile, err := s.Versions.HasWindowsGemfileLock(); err != nil {
 		return err
-	} else if hasFile {
-		s.Log.Debug("Remove %s", gemfileLock)
-		s.Log.Warning("Removing `Gemfile.lock` because it was generated on Windows.\nBundler will do a full resolve so native gems are handled properly.\nThis may result in unexpected gem versions being used in your app.\nIf you are using multi buildpacks, subsequent buildpacks may fail.\nIn rare occasions Bundler may not be able to resolve your dependencies at all.\nhttps://docs.cloudfoundry.org/buildpacks/ruby/windows.html")
-		if err := os.Remove(gemfileLock); err != nil {
-			return fmt.Errorf("Remove Gemfile.lock: %v", err)
-		}
 	}
+	dep.Name = "node"
+	dep.Version = version
 
-	// Remove .bundle/config && copy if exists
-	if exists, err := libbuildpack.FileExists(filepath.Join(tempDir, ".bundle", "config")); err != nil {
+	if err := s.Installer.InstallDependency(dep, tempDir); err != nil {
 		return err
-	} else if exists {
-		os.Remove(filepath.Join(tempDir, ".bundle", "config"))
-		libbuildpack.CopyFile(filepath.Join(s.Stager.BuildDir(), ".bundle", "config"), filepath.Join(tempDir, ".bundle", "config"))
 	}
 
-	args := []string{"install", "--without", os.Getenv("BUNDLE_WITHOUT"), "--jobs=4", "--retry=4", "--path", filepath.Join(s.Stager.DepDir(), "vendor_bundle"), "--binstubs", filepath.Join(s.Stager.DepDir(), "binstubs")}
-	if exists, err := libbuildpack.FileExists(gemfileLock); err != nil {
+	if err := os.Rename(filepath.Join(tempDir, fmt.Sprintf("node-v%s-linux-%s", dep.Version, nodeArch())), nodeInstallDir); err != nil {
 		return err
-	} else if exists {
-		args = append(args, "--deployment")
 	}
 
-	s.Log.BeginStep("Installing dependencies using bundler %s", s.Versions.GetBundlerVersion())
-	s.Log.Info("Running: bundle %s", strings.Join(args, " "))
-
-	env := os.Environ()
-	env = append(env, "NOKOGIRI_USE_SYSTEM_LIBRARIES=true")
-	freeTDSInstallDir := filepath.Join(s.Stager.DepDir(), "freetds")
-	env = append(env, "FREETDS_DIR="+freeTDSInstallDir)
+	return s.Stager.LinkDirectoryInDepDir(filepath.Join(nodeInstallDir, "bin"), "bin")
+}
 
-	cmd := exec.Command("bundle", args...)
-	cmd.Dir = tempDir
-	cmd.Stdout = text.NewIndentWriter(os.Stdout, []byte("       "))
-	cmd.Stderr = text.NewIndentWriter(os.Stderr, []byte("       "))
-	cmd.Env = env
-	if err := s.Command.Run(cmd); err != nil {
-		return err
+// nodeArch is the architecture in node's archive names: arm64 when the
+// buildpack runs on arm64, and x64 otherwise.
+func nodeArch() string {
+	if runtime.GOARCH == "arm64" {
+		return "arm64"
 	}
+	return "x64"
+}
 
-	if err := s.regenerateBundlerBinStub(tempDir); err != nil {
-		return err
-	}
+// PrefetchDependencies downloads every remaining dependency the app needs
+// before anything is installed or compiled, so network failures surface
+// immediately. The downloads land in the app cache, which InstallDependency
+// then reads from. FreeTDS and bundler are already installed at this point
+// because resolving the ruby version requires bundler.
+func (s *Supplier) PrefetchDependencies(engine, rubyVersion string) error {
+	s.Log.BeginStep("Fetching dependencies")
 
-	s.Log.Info("Cleaning up the bundler cache.")
+	deps := []libbuildpack.Dependency{{Name: engine, Version: rubyVersion}}
 
-	cmd = exec.Command("bundle", "clean")
-	cmd.Dir = tempDir
-	cmd.Stdout = text.NewIndentWriter(os.Stdout, []byte("       "))
-	cmd.Stderr = text.NewIndentWriter(os.Stderr, []byte("       "))
-	cmd.Env = env
-	if err := s.Command.Run(cmd); err != nil {
-		return err
+	if engine == "jruby" {
+		if exists, err := libbuildpack.FileExists(filepath.Join(s.Stager.BuildDir(), ".jdk")); err != nil {
+			return err
+		} else if !exists {
+			dep, err := s.onlyVersion("openjdk1.8-latest")
+			if err != nil {
+				return err
+			}
+			deps = append(deps, dep)
+		}
 	}
 
-	// Copy binstubs to bin
-	files, err := ioutil.ReadDir(filepath.Join(s.Stager.DepDir(), "binstubs"))
-	if err != nil {
-		if !os.IsNotExist(err) {
-			return fmt.Errorf("Could not read dep/binstubs directory: %v", err)
+	if versions := s.Manifest.AllDependencyVersions("rubygems"); len(versions) == 1 {
+		deps = append(deps, libbuildpack.Dependency{Name: "rubygems", Version: versions[0]})
+	}
+
+	if s.NeedsNode() {
+		version, err := s.nodeVersion()
+		if err != nil {
+			return err
 		}
-	} else {
-		for _, file := range files {
-			target := filepath.Join(s.Stager.DepDir(), "bin", file.Name())
-			if exists, err := libbuildpack.FileExists(target); err != nil {
-				return fmt.Errorf("Checking existence: %v", err)
-			} else if !exists {
-				source := filepath.Join(s.Stager.DepDir(), "binstubs", file.Name())
-				if err := libbuildpack.CopyFile(source, target); err != nil {
-					return fmt.Errorf("CopyFile: %v", err)
-				}
+		deps = append(deps, libbuildpack.Dependency{Name: "node", Version: version})
+
+		if exists, err := libbuildpack.FileExists(filepath.Join(s.Stager.BuildDir(), "yarn.lock")); err != nil {
+			return err
+		} else if exists {
+			dep, err := s.onlyVersion("yarn")
+			if err != nil {
+				return err
 			}
+			deps = append(deps, dep)
 		}
 	}
 
-	// Save .bundle/config to global config
-	if exists, err := libbuildpack.FileExists(filepath.Join(tempDir, ".bundle", "config")); err == nil && exists {
-		s.Log.Debug("SaveBundleConfig; %s -> %s", filepath.Join(tempDir, ".bundle", "config"), os.Getenv("BUNDLE_CONFIG"))
-		if err := os.Rename(filepath.Join(tempDir, ".bundle", "config"), os.Getenv("BUNDLE_CONFIG")); err != nil {
-			return err
-		}
+	tempDir, err := ioutil.TempDir("", "prefetch")
+	if err != nil {
+		return err
 	}
+	defer os.RemoveAll(tempDir)
 
-	// Save Gemfile.lock for finalize
-	gemfileLockTarget := filepath.Join(s.Stager.DepDir(), "Gemfile.lock")
-	if exists, err := libbuildpack.FileExists(gemfileLock); err == nil && exists {
-		s.Log.Debug("SaveGemfileLock; %s -> %s", gemfileLock, gemfileLockTarget)
-		if err := libbuildpack.CopyFile(gemfileLock, gemfileLockTarget); err != nil {
-			return err
+	for _, dep := range deps {
+		s.Log.Info("Fetching %s %s", dep.Name, dep.Version)
+		if err := s.Installer.FetchDependency(dep, filepath.Join(tempDir, dep.Name)); err != nil {
+			return fmt.Errorf("could not fetch %s %s: %v", dep.Name, dep.Version, err)
 		}
-	} else if err != nil {
-		fmt.Printf("Error checking if Gemfile.lock exists: %v", err)
 	}
 
-	return os.RemoveAll(tempDir)
+	return nil
 }
 
-func (s *Supplier) regenerateBundlerBinStub(appDir string) error {
-	s.Log.BeginStep("Regenerating bundler binstubs...")
-	cmd := exec.Command("bundle", "binstubs", "bundler", "--force", "--path", filepath.Join(s.Stager.DepDir(), "binstubs"))
-	cmd.Dir = appDir
-	cmd.Stdout = text.NewIndentWriter(os.Stdout, []byte("       "))
-	cmd.Stderr = text.NewIndentWriter(os.Stderr, []byte("       "))
-	if err := s.Command.Run(cmd); err != nil {
-		return err
+func (s *Supplier) onlyVersion(name string) (libbuildpack.Dependency, error) {
+	versions := s.Manifest.AllDependencyVersions(name)
+	if len(versions) > 1 {
+		return libbuildpack.Dependency{}, fmt.Errorf("more than one version of %s found", name)
+	} else if len(versions) == 0 {
+		return libbuildpack.Dependency{}, fmt.Errorf("no versions of %s found", name)
 	}
-	return libbuildpack.CopyFile(filepath.Join(s.Stager.DepDir(), "binstubs", "bundle"), filepath.Join(s.Stager.DepDir(), "bin", "bundle"))
+	return libbuildpack.Dependency{Name: name, Version: versions[0]}, nil
+}
+
+func (s *Supplier) NeedsNode() bool {
+	if s.cachedNeedsNode {
+		return s.needsNode
+	}
+	s.cachedNeedsNode = true
+	s.needsNode = false
+
+	if nodeInstallDisabled() {
+		s.Log.Info("Skipping install of nodejs since DISABLE_NODE_INSTALL is true")
+	} else if s.isNodeInstalled() {
+		if s.checkSuppliedNode() {
+			s.needsNode = true
+		} else {
+			s.Log.BeginStep("Skipping install of nodejs since it has been supplied")
+		}
+	} else {
+		for _, name := range []string{"webpacker", "execjs", "jsbundling-rails", "cssbundling-rails"} {
+			s.Log.Debug("Test %s in gemfile", name)
+			hasgem, err := s.Versions.HasGemVersion(name, ">=0.0.0")
+			if err == nil && hasgem {
+				s.Log.Debug("Found %s in gemfile", name)
+				s.needsNode = true
+				break
+			}
+		}
+		if !s.needsNode && s.hasPackageBuildScript() {
+			s.needsNode = true
+		}
+	}
+
+	return s.needsNode
+}
+
+// nodeInstallDisabled reports whether the app opted out of node and yarn,
+// e.g. because its assets are precompiled elsewhere.
+func nodeInstallDisabled() bool {
+	return os.Getenv("DISABLE_NODE_INSTALL") == "true"
+}
+
+func (s *Supplier) isNodeInstalled() bool {
+	_, err := s.Command.Output(s.Stager.BuildDir(), "node", "--version")
+	return err == nil
+}
+
+func (s *Supplier) InstallJVM() error {
+	if exists, err := libbuildpack.FileExists(filepath.Join(s.Stager.BuildDir(), ".jdk")); err != nil {
+		return err
+	} else if exists {
+		s.Log.Info("Using pre-installed JDK")
+		return nil
+	}
+
+	jvmInstallDir := filepath.Join(s.Stager.DepDir(), "jvm")
+	if err := s.Installer.InstallOnlyVersion("openjdk1.8-latest", jvmInstallDir); err != nil {
+		return err
+	}
+	if err := s.Stager.LinkDirectoryInDepDir(filepath.Join(jvmInstallDir, "bin"), "bin"); err != nil {
+		return err
+	}
+
+	scriptContents := `
+if ! [[ "${JAVA_OPTS}" == *-Xmx* ]]; then
+  export JAVA_MEM=${JAVA_MEM:--Xmx${JVM_MAX_HEAP:-384}m}
+fi
+export JAVA_OPTS=${JAVA_OPTS:--Xss512k -XX:+UseCompressedOops -Dfile.encoding=UTF-8}
+export JRUBY_OPTS=${JRUBY_OPTS:--Xcompile.invokedynamic=false}
+`
+
+	return s.Stager.WriteProfileD("jruby.sh", scriptContents)
+}
+
+func (s *Supplier) InstallRuby(name, version string) error {
+	installDir := filepath.Join(s.Stager.DepDir(), "ruby")
+
+	if err := s.Installer.InstallDependency(libbuildpack.Dependency{Name: name, Version: version}, installDir); err != nil {
+		return err
+	}
+
+	if err := s.RewriteShebangs(); err != nil {
+		return err
+	}
+
+	if err := os.Symlink("ruby", filepath.Join(s.Stager.DepDir(), "ruby", "bin", "ruby.exe")); err != nil {
+		return err
+	}
+
+	if err := s.Stager.LinkDirectoryInDepDir(filepath.Join(s.Stager.DepDir(), "ruby", "bin"), "bin"); err != nil {
+		return err
+	}
+
+	return s.VerifyRuby(name, version)
+}
+
+var rubyVersionOutput = regexp.MustCompile(`^ruby (\d+\.\d+\.\d+)`)
+
+// VerifyRuby runs the installed ruby, so a binary that cannot run on this
+// stack (e.g. one built against a newer glibc) fails staging rather than the
+// app's start. Only MRI is checked, since jruby reports its own version.
+func (s *Supplier) VerifyRuby(name, version string) error {
+	if name != "ruby" {
+		return nil
+	}
+
+	output, err := s.Command.Output(s.Stager.DepDir(), "ruby", "--version")
+	if err != nil {
+		return fmt.Errorf("The installed ruby %s does not run on the %s stack: %v\n%s", version, os.Getenv("CF_STACK"), err, strings.TrimSpace(output))
+	}
+
+	match := rubyVersionOutput.FindStringSubmatch(strings.TrimSpace(output))
+	if match == nil {
+		return fmt.Errorf("Could not find the version in the output of ruby --version: %s", strings.TrimSpace(output))
+	}
+	if match[1] != version {
+		return fmt.Errorf("Installed ruby %s, but ruby --version reports %s", version, match[1])
+	}
+	return nil
+}
+
+// WriteRubyVersionFile writes the installed ruby to $HOME/.ruby-version in
+// the droplet when BP_WRITE_RUBY_VERSION=true, so version-aware tools see the
+// ruby the app runs with. An existing .ruby-version is never overwritten.
+func (s *Supplier) WriteRubyVersionFile(engine, version string) error {
+	if os.Getenv("BP_WRITE_RUBY_VERSION") != "true" {
+		return nil
+	}
+
+	contents := version
+	if engine != "ruby" {
+		contents = engine + "-" + version
+	}
+
+	file := filepath.Join(s.Stager.BuildDir(), ".ruby-version")
+	if existing, err := ioutil.ReadFile(file); err == nil {
+		if strings.TrimSpace(string(existing)) != contents {
+			s.Log.Warning("Not replacing your .ruby-version (%s) with the installed ruby (%s)", strings.TrimSpace(string(existing)), contents)
+		}
+		return nil
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	return ioutil.WriteFile(file, []byte(contents+"\n"), 0644)
+}
+
+// shebangRegex matches a shebang that runs ruby, or ruby.exe, by its path.
+// The interpreter args after it are captured so the rewrite can keep them.
+var shebangRegex = regexp.MustCompile(`^#![^ \t\r\n]*/ruby[^ \t\r\n]*([^\r\n]*)`)
+
+// RewriteShebangs points ruby scripts in bin at #!/usr/bin/env ruby. Linux
+// passes everything after env as a single argument, so a script with
+// interpreter args is moved to .<name>-ruby and replaced by a wrapper that
+// passes the args to ruby in RUBYOPT.
+func (s *Supplier) RewriteShebangs() error {
+	files1, err := filepath.Glob(filepath.Join(s.Stager.DepDir(), "bin", "*"))
+	if err != nil {
+		return err
+	}
+	files2, err := filepath.Glob(filepath.Join(s.Stager.DepDir(), "vendor_bundle", "ruby", "*", "bin", "*"))
+	if err != nil {
+		return err
+	}
+
+	for _, file := range append(files1, files2...) {
+		fileInfo, err := os.Stat(file)
+		if err != nil {
+			return err
+		} else if fileInfo.IsDir() {
+			continue
+		}
+		fileContents, err := ioutil.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		// Only scripts are rewritten, binaries in bin are left untouched
+		if !bytes.HasPrefix(fileContents, []byte("#!")) {
+			continue
+		}
+		match := shebangRegex.FindSubmatch(fileContents)
+		if match == nil {
+			continue
+		}
+		rewritten := append([]byte("#!/usr/bin/env ruby"), fileContents[len(match[0]):]...)
+		rubyArgs := strings.TrimSpace(string(match[1]))
+		if rubyArgs == "" {
+			if err := ioutil.WriteFile(file, rewritten, fileInfo.Mode().Perm()); err != nil {
+				return err
+			}
+			continue
+		}
+
+		script := "." + filepath.Base(file) + "-ruby"
+		if err := ioutil.WriteFile(filepath.Join(filepath.Dir(file), script), rewritten, fileInfo.Mode().Perm()); err != nil {
+			return err
+		}
+		wrapper := fmt.Sprintf("#!/bin/sh\nRUBYOPT=%s\"${RUBYOPT:+ $RUBYOPT}\" exec \"$(dirname \"$(readlink -f \"$0\")\")/%s\" \"$@\"\n", shellQuote(rubyArgs), script)
+		if err := ioutil.WriteFile(file, []byte(wrapper), fileInfo.Mode().Perm()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// shellQuote single quotes value for /bin/sh.
+func shellQuote(value string) string {
+	return "'" + strings.Replace(value, "'", `'\''`, -1) + "'"
+}
+
+// StripGitDirs removes the .git history bundler checks out alongside each
+// git-sourced gem when BP_STRIP_GIT_DIRS=true. It is opt-in since a few
+// gemspecs shell out to git at runtime.
+func (s *Supplier) StripGitDirs() error {
+	if os.Getenv("BP_STRIP_GIT_DIRS") != "true" {
+		return nil
+	}
+
+	gitDirs, err := filepath.Glob(filepath.Join(s.Stager.DepDir(), "vendor_bundle", "*", "*", "bundler", "gems", "*", ".git"))
+	if err != nil {
+		return err
+	}
+
+	var reclaimed int64
+	for _, gitDir := range gitDirs {
+		err := filepath.Walk(gitDir, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if !info.IsDir() {
+				reclaimed += info.Size()
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		s.Log.Debug("Removing %s", gitDir)
+		if err := os.RemoveAll(gitDir); err != nil {
+			return err
+		}
+	}
+
+	if len(gitDirs) > 0 {
+		s.Log.Info("Removed .git from %d git-sourced gems, reclaiming %.1f MB", len(gitDirs), float64(reclaimed)/(1024*1024))
+	}
+	return nil
+}
+
+// CreateConvenienceSymlinks links rails, rake, bundle and ruby into
+// <depdir>/ruby_symlinks, which is put at the front of PATH, when
+// BP_CONVENIENCE_SYMLINKS=true. It must run after RewriteShebangs, and fails
+// if a linked script still points at the staging ruby.
+func (s *Supplier) CreateConvenienceSymlinks() error {
+	if os.Getenv("BP_CONVENIENCE_SYMLINKS") != "true" {
+		return nil
+	}
+
+	symlinksDir := filepath.Join(s.Stager.DepDir(), "ruby_symlinks")
+	if err := os.MkdirAll(symlinksDir, 0755); err != nil {
+		return err
+	}
+
+	shebangRegex := regexp.MustCompile(`^#!/.*/ruby.*`)
+	for _, name := range []string{"rails", "rake", "bundle", "ruby"} {
+		target := filepath.Join(s.Stager.DepDir(), "bin", name)
+		if exists, err := libbuildpack.FileExists(target); err != nil {
+			return err
+		} else if !exists {
+			s.Log.Debug("Not linking %s, %s does not exist", name, target)
+			continue
+		}
+
+		if body, err := ioutil.ReadFile(target); err != nil {
+			return err
+		} else if firstLine := strings.SplitN(string(body), "\n", 2)[0]; shebangRegex.MatchString(firstLine) && !strings.HasPrefix(firstLine, "#!/usr/bin/env ruby") {
+			return fmt.Errorf("shebang of %s was not rewritten: %s", target, firstLine)
+		}
+
+		link := filepath.Join(symlinksDir, name)
+		os.Remove(link)
+		if err := os.Symlink(filepath.Join("..", "bin", name), link); err != nil {
+			return err
+		}
+	}
+
+	if err := os.Setenv("PATH", symlinksDir+":"+os.Getenv("PATH")); err != nil {
+		return err
+	}
+	return s.writeRuntimeProfileD("ruby_symlinks.sh", fmt.Sprintf("export PATH=\"%s/ruby_symlinks:$PATH\"\n", s.runtimeDepDir()))
+}
+
+func (s *Supplier) SymlinkBundlerIntoRubygems() error {
+	s.Log.Debug("SymlinkBundlerIntoRubygems")
+
+	rubyEngineVersion, err := s.Versions.RubyEngineVersion()
+	if err != nil {
+		return fmt.Errorf("Unable to determine ruby engine: %s", err)
+	}
+
+	bundlerVersion := s.Versions.GetBundlerVersion()
+
+	destDir := filepath.Join(s.Stager.DepDir(), "ruby", "lib", "ruby", "gems", rubyEngineVersion, "gems")
+	if err := os.MkdirAll(destDir, 0755); err != nil {
+		return err
+	}
+	srcDir := filepath.Join(s.Stager.DepDir(), "bundler", "gems", "bundler-"+bundlerVersion)
+	relPath, err := filepath.Rel(destDir, srcDir)
+	if err != nil {
+		return err
+	}
+
+	destFile := filepath.Join(destDir, "bundler-"+bundlerVersion)
+	if found, err := libbuildpack.FileExists(destFile); err != nil {
+		return err
+	} else if found {
+		s.Log.Debug("Skipping linking bundler since destination exists")
+		return nil
+	}
+
+	return os.Symlink(relPath, destFile)
+}
+
+func (s *Supplier) UpdateRubygems() error {
+	dep := libbuildpack.Dependency{Name: "rubygems"}
+	versions := s.Manifest.AllDependencyVersions(dep.Name)
+	if len(versions) == 0 {
+		return nil
+	} else if len(versions) > 1 {
+		return fmt.Errorf("Too many versions of rubygems in manifest")
+	}
+	dep.Version = versions[0]
+
+	currVersion, err := s.Command.Output("/", "gem", "--version")
+	if err != nil {
+		return fmt.Errorf("Could not determine current version of rubygems: %v", err)
+	}
+
+	currVersion = strings.TrimSpace(currVersion)
+	if newer, err := s.Versions.VersionConstraint(currVersion, fmt.Sprintf(">= %s", dep.Version)); err != nil {
+		return fmt.Errorf("Could not parse rubygems version constraint: %s >= %s: %v", currVersion, dep.Version, err)
+	} else if newer {
+		return nil
+	}
+
+	if engine, err := s.Versions.Engine(); err != nil {
+		return err
+	} else if engine == "jruby" {
+		s.Log.Debug("Skipping update of rubygems since jruby")
+		return nil
+	}
+
+	s.Log.BeginStep("Update rubygems from %s to %s", currVersion, dep.Version)
+
+	tempDir, err := ioutil.TempDir("", "rubygems")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tempDir)
+
+	if err := s.Installer.InstallDependency(dep, tempDir); err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Join(s.Stager.DepDir(), "gem_home"), 0755); err != nil {
+		return err
+	}
+
+	rubygemsDir := filepath.Join(tempDir, fmt.Sprintf("rubygems-%s", dep.Version))
+	if exists, err := libbuildpack.FileExists(filepath.Join(rubygemsDir, "setup.rb")); err != nil {
+		return err
+	} else if !exists {
+		s.Log.Warning("Skipping update of rubygems, rubygems %s does not contain setup.rb", dep.Version)
+		return nil
+	}
+
+	if output, err := s.Command.Output(rubygemsDir, "ruby", "setup.rb"); err != nil {
+		if _, ok := err.(*exec.Error); ok {
+			s.Log.Warning("Skipping update of rubygems, could not run setup.rb: %v", err)
+			return nil
+		}
+		s.Log.Error("%s", output)
+		return fmt.Errorf("Could not install rubygems: %v\n%s", err, outputTail(output, 10))
+	}
+
+	return nil
+}
+
+// outputTail returns the last n lines of a command's output.
+func outputTail(output string, n int) string {
+	lines := strings.Split(strings.TrimRight(output, "\n"), "\n")
+	if len(lines) > n {
+		lines = lines[len(lines)-n:]
+	}
+	return strings.Join(lines, "\n")
+}
+
+type IndentedWriter struct {
+	w   io.Writer
+	pad string
+}
+
+func (w *IndentedWriter) Write(p []byte) (n int, err error) {
+	lines := strings.Split(string(p), "\n")
+	for i, line := range lines {
+		lines[i] = w.pad + line
+	}
+	p = []byte(strings.Join(lines, "\n"))
+	return w.Write(p)
+}
+
+type LinuxTempDir struct {
+	Log *libbuildpack.Logger
+}
+
+func (t *LinuxTempDir) CopyDirToTemp(dir string) (string, error) {
+	tempDir, err := ioutil.TempDir("", "app")
+	if err != nil {
+		return "", err
+	}
+	cmd := exec.Command("cp", "-al", dir, tempDir)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		t.Log.Error("%s", string(output))
+		return "", fmt.Errorf("Could not copy build dir to temp: %v", err)
+	}
+	tempDir = filepath.Join(tempDir, filepath.Base(dir))
+	return tempDir, nil
+}
+
+func (s *Supplier) InstallGems() error {
+	if !s.appHasGemfile {
+		s.warnProcfileBundle()
+		return nil
+	}
+
+	s.warnBundleConfig()
+	s.warnWindowsGemfile()
+	s.warnGemfileSource()
+	s.checkLockfilePlatforms()
+
+	tempDir, err := s.TempDir.CopyDirToTemp(s.Stager.BuildDir())
+	if err != nil {
+		return err
+	}
+	gemfile, err := filepath.Rel(s.Stager.BuildDir(), s.Versions.Gemfile())
+	if err != nil {
+		return err
+	} else if strings.HasPrefix(gemfile, "..") {
+		return fmt.Errorf("BUNDLE_GEMFILE %s is outside the app", os.Getenv("BUNDLE_GEMFILE"))
+	}
+	tempGemfile := filepath.Join(tempDir, gemfile)
+	gemfileLock := versions.GemfileLock(tempGemfile)
+
+	// The build dir may be mounted read-only, and the temp copy may hard link
+	// to it, so bundler must only ever write to a detached copy of the lock.
+	if err := s.detachFromBuildDir(gemfileLock); err != nil {
+		return err
+	}
+
+	if hasFile, err := s.Versions.HasWindowsGemfileLock(); err != nil {
+		return err
+	} else if hasFile && os.Getenv("BP_KEEP_GEMFILE_LOCK") == "true" {
+		s.Log.Warning("Keeping `Gemfile.lock`, which looks like it was generated on Windows, since BP_KEEP_GEMFILE_LOCK is true.\nIf Bundler cannot install from it, add the linux platform with `bundle lock --add-platform x86_64-linux`, or unset BP_KEEP_GEMFILE_LOCK.\nhttps://docs.cloudfoundry.org/buildpacks/ruby/windows.html")
+	} else if hasFile {
+		s.Log.Debug("Remove %s", gemfileLock)
+		s.Log.Warning("Removing `Gemfile.lock` because it was generated on Windows.\nBundler will do a full resolve so native gems are handled properly.\nThis may result in unexpected gem versions being used in your app.\nIf you are using multi buildpacks, subsequent buildpacks may fail.\nIn rare occasions Bundler may not be able to resolve your dependencies at all.\nhttps://docs.cloudfoundry.org/buildpacks/ruby/windows.html")
+		if err := os.Remove(gemfileLock); err != nil {
+			return fmt.Errorf("Remove Gemfile.lock: %v", err)
+		}
+	}
+
+	if err := s.warnRustGems(gemfileLock); err != nil {
+		return err
+	}
+	s.warnFreeTDSConflicts(gemfileLock)
+
+	// Remove .bundle/config && copy if exists
+	if exists, err := libbuildpack.FileExists(filepath.Join(tempDir, ".bundle", "config")); err != nil {
+		return err
+	} else if exists {
+		os.Remove(filepath.Join(tempDir, ".bundle", "config"))
+		libbuildpack.CopyFile(filepath.Join(s.Stager.BuildDir(), ".bundle", "config"), filepath.Join(tempDir, ".bundle", "config"))
+	}
+
+	bundleConfig, err := readBundleConfig(filepath.Join(s.Stager.BuildDir(), ".bundle", "config"))
+	if err != nil {
+		return fmt.Errorf("Could not read .bundle/config: %v", err)
+	}
+
+	args := []string{"install", "--without", os.Getenv("BUNDLE_WITHOUT")}
+	if _, set := bundleConfig["BUNDLE_JOBS"]; set && os.Getenv("BUNDLE_JOBS") == "" {
+		s.Log.Debug("Using BUNDLE_JOBS from .bundle/config")
+	} else {
+		args = append(args, fmt.Sprintf("--jobs=%d", s.bundleJobs()))
+	}
+	if _, set := bundleConfig["BUNDLE_RETRY"]; set && os.Getenv("BUNDLE_RETRY") == "" {
+		s.Log.Debug("Using BUNDLE_RETRY from .bundle/config")
+	} else {
+		args = append(args, fmt.Sprintf("--retry=%d", s.bundleRetry()))
+	}
+	args = append(args, "--path", filepath.Join(s.Stager.DepDir(), "vendor_bundle"), "--binstubs", filepath.Join(s.Stager.DepDir(), "binstubs"))
+	fullResolve := true
+	if exists, err := libbuildpack.FileExists(gemfileLock); err != nil {
+		return err
+	} else if exists {
+		args = append(args, "--deployment")
+		fullResolve = false
+	}
+	s.warnOverriddenBundleConfig(bundleConfig, map[string]string{
+		"BUNDLE_PATH":       filepath.Join(s.Stager.DepDir(), "vendor_bundle"),
+		"BUNDLE_BIN":        filepath.Join(s.Stager.DepDir(), "binstubs"),
+		"BUNDLE_DEPLOYMENT": strconv.FormatBool(!fullResolve),
+	})
+	frozen := os.Getenv("BUNDLE_FROZEN") == "true"
+	if frozen {
+		if fullResolve {
+			return fmt.Errorf("BUNDLE_FROZEN=true, but there is no Gemfile.lock to install from")
+		}
+		args = append(args, "--frozen")
+	}
+
+	gemfileLockChecksum, err := fileChecksum(gemfileLock)
+	if err != nil {
+		return err
+	}
+	freeTDSInstallDir := filepath.Join(s.Stager.DepDir(), "freetds")
+	extraEnv := []string{"NOKOGIRI_USE_SYSTEM_LIBRARIES=true", "FREETDS_DIR=" + freeTDSInstallDir, "BUNDLE_GEMFILE=" + tempGemfile}
+	if forced, err := s.forceSourceGems(gemfileLock); err != nil {
+		return err
+	} else if forced {
+		extraEnv = append(extraEnv, "BUNDLE_FORCE_RUBY_PLATFORM=true")
+	}
+	credentials := bundlerCredentials()
+	if len(credentials) > 0 {
+		s.Log.Debug("Passing bundler credentials to bundle install: %s", strings.Join(scrubEnv(credentials), " "))
+	}
+	env := withEnv(subprocessEnv(extraEnv...), credentials...)
+
+	local, err := s.useCachedGems(gemfileLockChecksum, tempDir, env)
+	if err != nil {
+		return err
+	} else if local {
+		args = append(args, "--local")
+	}
+
+	s.Log.BeginStep("Installing dependencies using bundler %s", s.Versions.GetBundlerVersion())
+	s.Log.Info("Running: bundle %s", strings.Join(args, " "))
+
+	if err := s.recordBundleInstall(args, env); err != nil {
+		return fmt.Errorf("Could not record the bundle install command: %v", err)
+	}
+
+	err = s.runBundleInstall(tempDir, args, env)
+	if err != nil && local {
+		// The restored vendor_bundle can still be missing gems, e.g. git gems
+		// or ones bundle clean removed, so retry with access to the network.
+		s.Log.Warning("Installing gems from the cache failed, retrying with a full bundle install")
+		args = withoutArg(args, "--local")
+		s.Log.Info("Running: bundle %s", strings.Join(args, " "))
+		if err := s.recordBundleInstall(args, env); err != nil {
+			return fmt.Errorf("Could not record the bundle install command: %v", err)
+		}
+		err = s.runBundleInstall(tempDir, args, env)
+	}
+	if err != nil {
+		return bundleInstallError(err, frozen)
+	}
+
+	if err := s.regenerateBundlerBinStub(tempDir); err != nil {
+		return err
+	}
+
+	// bundle clean keeps the droplet small, but removes gems the next build
+	// could have reused after a Gemfile.lock change.
+	if os.Getenv("BP_SKIP_BUNDLE_CLEAN") == "true" {
+		s.Log.Info("Skipping bundle clean, since BP_SKIP_BUNDLE_CLEAN is true.")
+	} else {
+		s.Log.Info("Cleaning up the bundler cache.")
+
+		cmd := exec.Command("bundle", "clean")
+		cmd.Dir = tempDir
+		cmd.Stdout = text.NewIndentWriter(os.Stdout, []byte("       "))
+		cmd.Stderr = text.NewIndentWriter(os.Stderr, []byte("       "))
+		cmd.Env = env
+		if err := s.Command.Run(cmd); err != nil {
+			return err
+		}
+	}
+
+	// Copy binstubs to bin
+	files, err := ioutil.ReadDir(filepath.Join(s.Stager.DepDir(), "binstubs"))
+	if err != nil {
+		if !os.IsNotExist(err) {
+			return fmt.Errorf("Could not read dep/binstubs directory: %v", err)
+		}
+	} else {
+		for _, file := range files {
+			target := filepath.Join(s.Stager.DepDir(), "bin", file.Name())
+			if exists, err := libbuildpack.FileExists(target); err != nil {
+				return fmt.Errorf("Checking existence: %v", err)
+			} else if !exists {
+				source := filepath.Join(s.Stager.DepDir(), "binstubs", file.Name())
+				if err := libbuildpack.CopyFile(source, target); err != nil {
+					return fmt.Errorf("CopyFile: %v", err)
+				}
+				if err := s.ensureExecutable(target); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	s.Cache.Metadata().GemfileLockChecksum = gemfileLockChecksum
+
+	// Save .bundle/config to global config
+	if exists, err := libbuildpack.FileExists(filepath.Join(tempDir, ".bundle", "config")); err == nil && exists {
+		s.Log.Debug("SaveBundleConfig; %s -> %s", filepath.Join(tempDir, ".bundle", "config"), os.Getenv("BUNDLE_CONFIG"))
+		if err := os.Rename(filepath.Join(tempDir, ".bundle", "config"), os.Getenv("BUNDLE_CONFIG")); err != nil {
+			return err
+		}
+	}
+	if err := s.saveBundlerCredentials(credentials); err != nil {
+		return fmt.Errorf("Could not save bundler credentials: %v", err)
+	}
+
+	// Save Gemfile.lock for finalize, at the same path relative to the dep dir
+	gemfileLockTarget := filepath.Join(s.Stager.DepDir(), versions.GemfileLock(gemfile))
+	if exists, err := libbuildpack.FileExists(gemfileLock); err == nil && exists {
+		s.Log.Debug("SaveGemfileLock; %s -> %s", gemfileLock, gemfileLockTarget)
+		if err := os.MkdirAll(filepath.Dir(gemfileLockTarget), 0755); err != nil {
+			return err
+		}
+		if err := libbuildpack.CopyFile(gemfileLock, gemfileLockTarget); err != nil {
+			return err
+		}
+	} else if err != nil {
+		fmt.Printf("Error checking if Gemfile.lock exists: %v", err)
+	}
+
+	if fullResolve {
+		if err := s.verifyGemfileLock(tempDir, env); err != nil {
+			return err
+		}
+	}
+
+	if err := s.RunBundleAudit(tempDir, env); err != nil {
+		return err
+	}
+
+	return os.RemoveAll(tempDir)
+}
+
+// RunBundleAudit checks the installed gems for known vulnerabilities when the
+// app bundles bundler-audit, so only apps that opt in pay for the check.
+// Advisories, and a check that cannot run, are warnings unless
+// BUNDLE_AUDIT_STRICT=true, which fails staging instead.
+func (s *Supplier) RunBundleAudit(appDir string, env []string) error {
+	hasBundlerAudit, err := s.Versions.HasGemVersion("bundler-audit", ">=0.0.0")
+	if err != nil {
+		s.Log.Debug("Could not check the Gemfile.lock for bundler-audit: %v", err)
+		return nil
+	} else if !hasBundlerAudit {
+		return nil
+	}
+
+	s.Log.BeginStep("Checking gems for known vulnerabilities")
+
+	output := new(bytes.Buffer)
+	cmd := exec.Command("bundle", "exec", "bundle-audit", "check", "--update")
+	cmd.Dir = appDir
+	cmd.Stdout = output
+	cmd.Stderr = output
+	cmd.Env = env
+	if err := s.Command.Run(cmd); err != nil {
+		report := strings.TrimSpace(output.String())
+		if os.Getenv("BUNDLE_AUDIT_STRICT") == "true" {
+			return fmt.Errorf("bundle-audit check failed: %v\n%s", err, report)
+		}
+		s.Log.Warning("bundle-audit check failed: %v\n%s\nSet BUNDLE_AUDIT_STRICT=true to fail staging when it does.", err, report)
+		return nil
+	}
+
+	s.Log.Info("%s", strings.TrimSpace(output.String()))
+	return nil
+}
+
+// saveBundlerCredentials adds the bundler credentials to the saved bundle
+// config, which finalize restores as the app's .bundle/config, so bundler
+// can still reach private gem sources after supply. They replace settings
+// of the same name, and the file is made readable only by its owner.
+func (s *Supplier) saveBundlerCredentials(credentials []string) error {
+	bundleConfig := os.Getenv("BUNDLE_CONFIG")
+	if len(credentials) == 0 || bundleConfig == "" {
+		return nil
+	}
+
+	body, err := ioutil.ReadFile(bundleConfig)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	values := map[string]string{}
+	var names []string
+	for _, credential := range credentials {
+		parts := strings.SplitN(credential, "=", 2)
+		values[parts[0]] = parts[1]
+		names = append(names, parts[0])
+	}
+
+	lines := []string{"---"}
+	for _, line := range strings.Split(string(body), "\n") {
+		name := strings.TrimSpace(strings.SplitN(line, ":", 2)[0])
+		if _, ok := values[name]; ok || line == "" || line == "---" {
+			continue
+		}
+		lines = append(lines, line)
+	}
+	for _, name := range names {
+		lines = append(lines, fmt.Sprintf("%s: %q", name, values[name]))
+	}
+
+	s.Log.Debug("Saving bundler credentials to %s: %s", bundleConfig, strings.Join(scrubEnv(credentials), " "))
+	if err := ioutil.WriteFile(bundleConfig, []byte(strings.Join(lines, "\n")+"\n"), 0600); err != nil {
+		return err
+	}
+	return os.Chmod(bundleConfig, 0600)
+}
+
+// ensureExecutable makes a binstub copied into <depdir>/bin executable, since
+// binstubs written by bundler or rails are not always created with the
+// execute bit and would otherwise fail with permission denied at runtime.
+func (s *Supplier) ensureExecutable(binstub string) error {
+	info, err := os.Stat(binstub)
+	if err != nil {
+		return err
+	}
+	if info.Mode()&0111 == 0111 {
+		return nil
+	}
+
+	s.Log.Info("Making bin/%s executable", filepath.Base(binstub))
+	if err := os.Chmod(binstub, info.Mode()|0755); err != nil {
+		return fmt.Errorf("Could not make %s executable: %v", binstub, err)
+	}
+	return nil
+}
+
+// verifyGemfileLock runs bundle check against the Gemfile.lock produced by a
+// full resolve, so a lockfile that does not match the installed gems fails
+// staging instead of failing when the app starts.
+func (s *Supplier) verifyGemfileLock(appDir string, env []string) error {
+	s.Log.Info("Verifying the resolved Gemfile.lock")
+
+	output := new(bytes.Buffer)
+	cmd := exec.Command("bundle", "check")
+	cmd.Dir = appDir
+	cmd.Stdout = output
+	cmd.Stderr = output
+	cmd.Env = env
+	if err := s.Command.Run(cmd); err != nil {
+		return fmt.Errorf("bundle check failed for the resolved Gemfile.lock: %v\n%s", err, strings.TrimSpace(output.String()))
+	}
+	return nil
+}
+
+// detachFromBuildDir replaces file in the temp copy of the build dir with a
+// writable copy that shares nothing with the original, since cp -al hard
+// links every file. It refuses to touch files in the build dir itself.
+func (s *Supplier) detachFromBuildDir(file string) error {
+	if rel, err := filepath.Rel(s.Stager.BuildDir(), file); err == nil && !strings.HasPrefix(rel, "..") {
+		return fmt.Errorf("refusing to modify %s, the build dir may be read-only", rel)
+	}
+
+	info, err := os.Stat(file)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	contents, err := ioutil.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(file); err != nil {
+		return fmt.Errorf("could not detach %s from the build dir: %v", filepath.Base(file), err)
+	}
+	return ioutil.WriteFile(file, contents, info.Mode()|0200)
+}
+
+func (s *Supplier) regenerateBundlerBinStub(appDir string) error {
+	s.Log.BeginStep("Regenerating bundler binstubs...")
+	cmd := exec.Command("bundle", "binstubs", "bundler", "--force", "--path", filepath.Join(s.Stager.DepDir(), "binstubs"))
+	cmd.Dir = appDir
+	cmd.Stdout = text.NewIndentWriter(os.Stdout, []byte("       "))
+	cmd.Stderr = text.NewIndentWriter(os.Stderr, []byte("       "))
+	cmd.Env = subprocessEnv()
+	if err := s.Command.Run(cmd); err != nil {
+		return err
+	}
+	target := filepath.Join(s.Stager.DepDir(), "bin", "bundle")
+	if err := libbuildpack.CopyFile(filepath.Join(s.Stager.DepDir(), "binstubs", "bundle"), target); err != nil {
+		return err
+	}
+	return s.ensureExecutable(target)
 }
 
 func (s *Supplier) EnableLDLibraryPathEnv() error {
@@ -729,131 +1897,540 @@ func (s *Supplier) EnableLDLibraryPathEnv() error {
 		return err
 	}
 
-	if err := s.Stager.WriteEnvFile("LD_LIBRARY_PATH", envVar); err != nil {
+	if err := s.Stager.WriteEnvFile("LD_LIBRARY_PATH", envVar); err != nil {
+		return err
+	}
+
+	scriptContents := fmt.Sprintf(`export %[1]s="%[2]s$([[ ! -z "${%[1]s:-}" ]] && echo ":$%[1]s")"`, "LD_LIBRARY_PATH", filepath.Join("$HOME", "ld_library_path"))
+	return s.Stager.WriteProfileD("app_lib_path.sh", scriptContents)
+}
+
+func (s *Supplier) CreateDefaultEnv() error {
+	environmentDefaults := map[string]string{
+		"RAILS_ENV":      "production",
+		"RACK_ENV":       "production",
+		"RAILS_GROUPS":   "assets",
+		"BUNDLE_WITHOUT": "development:test",
+		"BUNDLE_GEMFILE": "Gemfile",
+		"BUNDLE_BIN":     filepath.Join(s.Stager.DepDir(), "binstubs"),
+		"BUNDLE_CONFIG":  filepath.Join(s.Stager.DepDir(), "bundle_config"),
+		"GEM_HOME":       filepath.Join(s.Stager.DepDir(), "gem_home"),
+		"GEM_PATH": strings.Join([]string{
+			filepath.Join(s.Stager.DepDir(), "bundler"),
+			filepath.Join(s.Stager.DepDir(), "gem_home"),
+		}, ":"),
+	}
+
+	if err := s.writeEnvFiles(environmentDefaults, false); err != nil {
+		return err
+	}
+
+	if additional := os.Getenv("BUNDLE_ADDITIONAL_WITHOUT"); additional != "" {
+		without := mergeBundleGroups(os.Getenv("BUNDLE_WITHOUT"), additional)
+		s.Log.Debug("Installing gems without the %s groups", without)
+		if err := s.writeEnvFiles(map[string]string{"BUNDLE_WITHOUT": without}, true); err != nil {
+			return err
+		}
+	}
+	return s.checkAssetsGroup()
+}
+
+// checkAssetsGroup warns when RAILS_GROUPS asks for the assets group but
+// BUNDLE_WITHOUT leaves its gems out of the install, which makes precompiling
+// assets fail on missing gems. With BP_INCLUDE_ASSETS_GROUP=true the assets
+// group is taken out of BUNDLE_WITHOUT instead.
+func (s *Supplier) checkAssetsGroup() error {
+	if !railsGroupsInclude("assets") {
+		return nil
+	}
+
+	excluded := false
+	var without []string
+	for _, group := range strings.FieldsFunc(os.Getenv("BUNDLE_WITHOUT"), func(r rune) bool { return r == ':' || r == ' ' }) {
+		if group == "assets" {
+			excluded = true
+		} else {
+			without = append(without, group)
+		}
+	}
+	if !excluded {
+		return nil
+	}
+
+	if os.Getenv("BP_INCLUDE_ASSETS_GROUP") == "true" {
+		s.Log.Info("Installing the assets gem group, since RAILS_GROUPS includes it and BP_INCLUDE_ASSETS_GROUP is true")
+		return s.writeEnvFiles(map[string]string{"BUNDLE_WITHOUT": strings.Join(without, ":")}, true)
+	}
+	s.Log.Warning("RAILS_GROUPS includes assets, but BUNDLE_WITHOUT (%s) leaves out the assets gem group, so precompiling assets may fail on missing gems.\nRemove assets from BUNDLE_WITHOUT, or set BP_INCLUDE_ASSETS_GROUP=true to install the group anyway.", os.Getenv("BUNDLE_WITHOUT"))
+	return nil
+}
+
+// mergeBundleGroups joins colon separated lists of bundler groups, dropping
+// empty and repeated groups and keeping the first occurrence of each.
+func mergeBundleGroups(lists ...string) string {
+	var groups []string
+	seen := map[string]bool{}
+	for _, list := range lists {
+		for _, group := range strings.Split(list, ":") {
+			group = strings.TrimSpace(group)
+			if group == "" || seen[group] {
+				continue
+			}
+			seen[group] = true
+			groups = append(groups, group)
+		}
+	}
+	return strings.Join(groups, ":")
+}
+
+func (s *Supplier) AddPostRubyInstallDefaultEnv(engine string) error {
+	rubyEngineVersion, err := s.Versions.RubyEngineVersion()
+	if err != nil {
+		s.Log.Error("Unable to determine ruby engine: %s", err.Error())
+		return err
+	}
+	environmentDefaults := map[string]string{
+		"BUNDLE_PATH": filepath.Join(s.Stager.DepDir(), "vendor_bundle", engine, rubyEngineVersion),
+		"GEM_PATH": strings.Join([]string{
+			filepath.Join(s.Stager.DepDir(), "bundler"),
+			filepath.Join(s.Stager.DepDir(), "vendor_bundle", engine, rubyEngineVersion),
+			filepath.Join(s.Stager.DepDir(), "gem_home"),
+		}, ":"),
+	}
+	s.Log.Debug("Setting post ruby install env: %v", environmentDefaults)
+	return s.writeEnvFiles(environmentDefaults, true)
+}
+
+func (s *Supplier) writeEnvFiles(environment map[string]string, clobber bool) error {
+	for envVar, envDefault := range environment {
+		if os.Getenv(envVar) == "" || clobber {
+			_ = os.Setenv(envVar, envDefault)
+			if err := s.Stager.WriteEnvFile(envVar, envDefault); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// PrecompileAssets runs rake assets:precompile for a Rails app that opts in
+// with BP_PRECOMPILE_ASSETS=true, for when the final buildpack does not
+// compile them. RAILS_GROUPS must include assets, as it does by default (see
+// CreateDefaultEnv). It is skipped when the app has a sprockets manifest,
+// since its assets were then compiled locally.
+func (s *Supplier) PrecompileAssets() error {
+	if os.Getenv("BP_PRECOMPILE_ASSETS") != "true" || !railsGroupsInclude("assets") || !s.appHasGemfile || !s.appHasGemfileLock {
+		return nil
+	}
+	if hasRails, err := s.Versions.HasGemVersion("rails", ">= 0"); err != nil {
+		return fmt.Errorf("Could not determine whether the app uses rails: %v", err)
+	} else if !hasRails {
+		return nil
+	}
+
+	if matches, err := filepath.Glob(filepath.Join(s.Stager.BuildDir(), "public", "assets", ".sprockets-manifest*")); err != nil {
+		return err
+	} else if len(matches) > 0 {
+		s.Log.Info("Detected assets manifest file, assuming assets were compiled locally")
+		return nil
+	}
+
+	env := subprocessEnv(fmt.Sprintf("PATH=%s:%s", filepath.Join(s.Stager.DepDir(), "bin"), os.Getenv("PATH")))
+	if _, exists := os.LookupEnv("SECRET_KEY_BASE"); !exists {
+		env = append(env, "SECRET_KEY_BASE=dummy-staging-key")
+	}
+
+	s.Log.BeginStep("Precompiling assets")
+	startTime := time.Now()
+	cmd := exec.Command("bundle", "exec", "rake", "assets:precompile")
+	cmd.Dir = s.Stager.BuildDir()
+	cmd.Stdout = text.NewIndentWriter(os.Stdout, []byte("       "))
+	cmd.Stderr = text.NewIndentWriter(os.Stderr, []byte("       "))
+	cmd.Env = env
+	if err := s.Command.Run(cmd); err != nil {
+		return fmt.Errorf("rake assets:precompile failed: %v", err)
+	}
+
+	s.Log.Info("Asset precompilation completed (%v)", time.Since(startTime))
+	return nil
+}
+
+// railsGroupsInclude reports whether the comma separated RAILS_GROUPS names
+// group.
+func railsGroupsInclude(group string) bool {
+	for _, name := range envPatterns(os.Getenv("RAILS_GROUPS")) {
+		if name == group {
+			return true
+		}
+	}
+	return false
+}
+
+// rubyGCTuning are the GC settings ruby.sh defaults when BP_RUBY_GC_TUNING
+// is true, sized for heap-heavy Rails apps.
+var rubyGCTuning = []struct{ name, value string }{
+	{"RUBY_GC_HEAP_INIT_SLOTS", "600000"},
+	{"RUBY_GC_HEAP_FREE_SLOTS_MIN_RATIO", "0.20"},
+	{"RUBY_GC_HEAP_FREE_SLOTS_GOAL_RATIO", "0.40"},
+	{"RUBY_GC_HEAP_GROWTH_FACTOR", "1.25"},
+	{"RUBY_GC_MALLOC_LIMIT", "64000000"},
+	{"RUBY_GC_MALLOC_LIMIT_MAX", "128000000"},
+	{"RUBY_GC_OLDMALLOC_LIMIT", "64000000"},
+	{"RUBY_GC_OLDMALLOC_LIMIT_MAX", "128000000"},
+}
+
+func (s *Supplier) WriteProfileD(engine string) error {
+	s.Log.BeginStep("Creating runtime environment")
+
+	rubyEngineVersion, err := s.Versions.RubyEngineVersion()
+	if err != nil {
+		return err
+	}
+	gemfile, err := filepath.Rel(s.Stager.BuildDir(), s.Versions.Gemfile())
+	if err != nil {
+		return err
+	}
+
+	scriptContents := fmt.Sprintf(`
+export LANG=${LANG:-en_US.UTF-8}
+export RAILS_ENV=${RAILS_ENV:-production}
+export RACK_ENV=${RACK_ENV:-production}
+export RAILS_SERVE_STATIC_FILES=${RAILS_SERVE_STATIC_FILES:-enabled}
+export RAILS_LOG_TO_STDOUT=${RAILS_LOG_TO_STDOUT:-enabled}
+export BUNDLE_GEMFILE=${BUNDLE_GEMFILE:-$HOME/%[5]s}
+
+export GEM_HOME=${GEM_HOME:-%[1]s/gem_home}
+export GEM_PATH=${GEM_PATH:-%[1]s/vendor_bundle/%[2]s/%[3]s:%[1]s/gem_home:%[1]s/bundler}
+export BUNDLE_PATH=${BUNDLE_PATH:-%[1]s/vendor_bundle/%[2]s/%[3]s}
+
+## Change to current DEPS_DIR
+bundle config PATH "%[1]s/vendor_bundle" > /dev/null
+bundle config WITHOUT "%[4]s" > /dev/null
+`, s.runtimeDepDir(), engine, rubyEngineVersion, os.Getenv("BUNDLE_WITHOUT"), gemfile)
+
+	// Fewer malloc arenas keep threaded servers' RSS down. Setting
+	// MALLOC_ARENA_MAX to empty leaves glibc's default in place.
+	if value, isSet := os.LookupEnv("MALLOC_ARENA_MAX"); !isSet || value != "" {
+		scriptContents += "\nexport MALLOC_ARENA_MAX=${MALLOC_ARENA_MAX:-2}\n"
+	}
+
+	if os.Getenv("BP_RUBY_GC_TUNING") == "true" {
+		scriptContents += "\n"
+		for _, setting := range rubyGCTuning {
+			scriptContents += fmt.Sprintf("export %[1]s=${%[1]s:-%[2]s}\n", setting.name, setting.value)
+		}
+	}
+
+	timezone, err := s.appTimezone()
+	if err != nil {
+		return err
+	}
+	if timezone != "" {
+		scriptContents += fmt.Sprintf("\nexport TZ=${TZ:-%s}\n", timezone)
+	}
+
+	// YJIT ships with MRI 3.1 and later; RUBY_YJIT_ENABLE=0 turns it off
+	if engine == "ruby" {
+		hasYJIT, err := s.Versions.VersionConstraint(rubyEngineVersion, ">= 3.1.0")
+		if err != nil {
+			return fmt.Errorf("Could not determine whether ruby %s has YJIT: %v", rubyEngineVersion, err)
+		}
+		if hasYJIT {
+			scriptContents += "\nexport RUBY_YJIT_ENABLE=${RUBY_YJIT_ENABLE:-1}\n"
+		}
+	}
+
+	if s.appHasGemfile && s.appHasGemfileLock {
+		hasRails41, err := s.Versions.HasGemVersion("rails", ">=4.1.0.beta1")
+		if err != nil {
+			return fmt.Errorf("Could not determine rails version: %v", err)
+		}
+		if hasRails41 && os.Getenv("BP_SKIP_SECRET_KEY_BASE") == "true" {
+			s.Log.Debug("Not setting a default SECRET_KEY_BASE, since BP_SKIP_SECRET_KEY_BASE is true")
+		} else if hasRails41 && os.Getenv("SECRET_KEY_BASE") != "" {
+			s.Log.Debug("Not generating a SECRET_KEY_BASE, since SECRET_KEY_BASE is set")
+		} else if hasRails41 {
+			metadata := s.Cache.Metadata()
+			if metadata.SecretKeyBase == "" {
+				metadata.SecretKeyBase, err = s.rakeSecret()
+				if err != nil {
+					return fmt.Errorf("Failed to run 'rake secret': %v", err)
+				}
+			}
+			if metadata.SecretKeyBase != "" {
+				scriptContents += fmt.Sprintf("\nexport SECRET_KEY_BASE=${SECRET_KEY_BASE:-%s}\n", metadata.SecretKeyBase)
+			}
+		}
+	}
+
+	return s.writeRuntimeProfileD("ruby.sh", scriptContents)
+}
+
+// TimezoneFile names the app file that can set TZ, e.g. Europe/London.
+const TimezoneFile = ".timezone"
+
+var timezonePattern = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9_+-]*(/[A-Za-z0-9_+-]+)*$`)
+
+// appTimezone returns the TZ the app asks for, from TZ or else .timezone. It
+// is empty when the app sets neither, so the platform default applies.
+func (s *Supplier) appTimezone() (string, error) {
+	timezone, source := os.Getenv("TZ"), "TZ"
+	if timezone == "" {
+		body, err := ioutil.ReadFile(filepath.Join(s.Stager.BuildDir(), TimezoneFile))
+		if os.IsNotExist(err) {
+			return "", nil
+		} else if err != nil {
+			return "", err
+		}
+		timezone, source = strings.TrimSpace(string(body)), TimezoneFile
+	}
+	if timezone == "" {
+		return "", nil
+	}
+	if !timezonePattern.MatchString(timezone) || strings.Contains(timezone, "..") {
+		return "", fmt.Errorf("%s %s is not a tz database name, such as Europe/London or UTC", source, timezone)
+	}
+	return timezone, nil
+}
+
+const defaultRakeSecretTimeout = 2 * time.Minute
+
+// rakeSecret runs rake secret, which boots the app and so can hang on, for
+// example, a database that is not reachable from staging. It is given
+// BP_RAKE_SECRET_TIMEOUT (a duration such as 90s) per attempt and retried
+// BP_RAKE_SECRET_RETRIES times after a timeout. When every attempt times out,
+// or rake secret fails because the app cannot boot while staging, it warns
+// and returns an empty secret, so no default SECRET_KEY_BASE is set (or
+// cached, so the next staging tries again).
+func (s *Supplier) rakeSecret() (string, error) {
+	timeout := defaultRakeSecretTimeout
+	if value := os.Getenv("BP_RAKE_SECRET_TIMEOUT"); value != "" {
+		var err error
+		if timeout, err = time.ParseDuration(value); err != nil || timeout <= 0 {
+			return "", fmt.Errorf("BP_RAKE_SECRET_TIMEOUT %s is not a positive duration", value)
+		}
+	}
+	retries := 0
+	if value := os.Getenv("BP_RAKE_SECRET_RETRIES"); value != "" {
+		var err error
+		if retries, err = strconv.Atoi(value); err != nil || retries < 0 {
+			return "", fmt.Errorf("BP_RAKE_SECRET_RETRIES %s is not a number of retries", value)
+		}
+	}
+
+	for attempt := 0; attempt <= retries; attempt++ {
+		output, err := s.outputWithTimeout(timeout, s.Stager.BuildDir(), "bundle", "exec", "rake", "secret")
+		if err == errCommandTimeout {
+			s.Log.Debug("rake secret attempt %d timed out after %s", attempt+1, timeout)
+			continue
+		} else if err != nil {
+			s.Log.Warning("rake secret failed (%v), so no default SECRET_KEY_BASE was set.\nSet SECRET_KEY_BASE for your app, e.g. cf set-env <app> SECRET_KEY_BASE $(rails secret)", err)
+			return "", nil
+		}
+		return strings.TrimSpace(output), nil
+	}
+
+	s.Log.Warning("rake secret did not finish within %s, so no default SECRET_KEY_BASE was set.\nSet SECRET_KEY_BASE for your app, or raise BP_RAKE_SECRET_TIMEOUT if your app is slow to boot.", timeout)
+	return "", nil
+}
+
+var errCommandTimeout = errors.New("command timed out")
+
+// outputWithTimeout returns the stdout of program like Command.Output, but
+// kills it and returns errCommandTimeout once timeout has passed. program
+// gets the filtered subprocessEnv.
+func (s *Supplier) outputWithTimeout(timeout time.Duration, dir, program string, args ...string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	output := new(bytes.Buffer)
+	cmd := exec.CommandContext(ctx, program, args...)
+	cmd.Dir = dir
+	cmd.Env = subprocessEnv()
+	cmd.Stdout = output
+	cmd.Stderr = os.Stderr
+	err := s.Command.Run(cmd)
+	if ctx.Err() == context.DeadlineExceeded {
+		return "", errCommandTimeout
+	}
+	return output.String(), err
+}
+
+// InvalidateCachedGems removes a vendor_bundle restored from the cache that
+// was built by a different ruby, so native extensions are rebuilt, and
+// records the ruby the gems are about to be built with.
+func (s *Supplier) InvalidateCachedGems(engine, rubyVersion string) error {
+	metadata := s.Cache.Metadata()
+	ruby, cachedRuby := engine+"-"+rubyVersion, metadata.Ruby
+	metadata.Ruby = ruby
+
+	if cachedRuby == "" || cachedRuby == ruby {
+		return nil
+	}
+	vendorBundle := filepath.Join(s.Stager.DepDir(), "vendor_bundle")
+	if exists, err := libbuildpack.FileExists(vendorBundle); err != nil || !exists {
+		return err
+	}
+
+	s.Log.Info("Reinstalling gems, since the cached gems were built with %s rather than %s", cachedRuby, ruby)
+	metadata.GemfileLockChecksum = ""
+	return os.RemoveAll(vendorBundle)
+}
+
+// bundleInstallError explains a failed frozen bundle install, which most
+// often means Gemfile.lock is out of date with the Gemfile.
+func bundleInstallError(err error, frozen bool) error {
+	if !frozen {
+		return err
+	}
+	return fmt.Errorf("%v\nBUNDLE_FROZEN=true, so bundler will not update Gemfile.lock. If it is out of date with the Gemfile, run bundle install locally and commit Gemfile.lock.", err)
+}
+
+// runBundleInstall runs bundle install in dir. Native extension builds are
+// noisy, so unless GEM_BUILD_VERBOSE=true the output is only shown when
+// bundle install fails.
+func (s *Supplier) runBundleInstall(dir string, args, env []string) error {
+	cmd := exec.Command("bundle", args...)
+	cmd.Dir = dir
+	cmd.Env = env
+	if os.Getenv("GEM_BUILD_VERBOSE") == "true" {
+		cmd.Stdout = text.NewIndentWriter(os.Stdout, []byte("       "))
+		cmd.Stderr = text.NewIndentWriter(os.Stderr, []byte("       "))
+		return s.Command.Run(cmd)
+	}
+
+	output := new(bytes.Buffer)
+	cmd.Stdout = output
+	cmd.Stderr = output
+	if err := s.Command.Run(cmd); err != nil {
+		s.Log.Info("%s", strings.TrimRight(output.String(), "\n"))
 		return err
 	}
-
-	scriptContents := fmt.Sprintf(`export %[1]s="%[2]s$([[ ! -z "${%[1]s:-}" ]] && echo ":$%[1]s")"`, "LD_LIBRARY_PATH", filepath.Join("$HOME", "ld_library_path"))
-	return s.Stager.WriteProfileD("app_lib_path.sh", scriptContents)
+	return nil
 }
 
-func (s *Supplier) CreateDefaultEnv() error {
-	environmentDefaults := map[string]string{
-		"RAILS_ENV":      "production",
-		"RACK_ENV":       "production",
-		"RAILS_GROUPS":   "assets",
-		"BUNDLE_WITHOUT": "development:test",
-		"BUNDLE_GEMFILE": "Gemfile",
-		"BUNDLE_BIN":     filepath.Join(s.Stager.DepDir(), "binstubs"),
-		"BUNDLE_CONFIG":  filepath.Join(s.Stager.DepDir(), "bundle_config"),
-		"GEM_HOME":       filepath.Join(s.Stager.DepDir(), "gem_home"),
-		"GEM_PATH": strings.Join([]string{
-			filepath.Join(s.Stager.DepDir(), "bundler"),
-			filepath.Join(s.Stager.DepDir(), "gem_home"),
-		}, ":"),
+// withoutArg returns a copy of args with every occurrence of arg removed.
+func withoutArg(args []string, arg string) []string {
+	kept := []string{}
+	for _, a := range args {
+		if a != arg {
+			kept = append(kept, a)
+		}
 	}
-
-	return s.writeEnvFiles(environmentDefaults, false)
+	return kept
 }
 
-func (s *Supplier) AddPostRubyInstallDefaultEnv(engine string) error {
-	rubyEngineVersion, err := s.Versions.RubyEngineVersion()
-	if err != nil {
-		s.Log.Error("Unable to determine ruby engine: %s", err.Error())
-		return err
+const defaultBundleJobs = 4
+
+// bundleJobs is how many gems bundle install builds in parallel, from
+// BUNDLE_JOBS. More jobs use more CPUs but also more memory while native
+// extensions compile.
+func (s *Supplier) bundleJobs() int {
+	value := os.Getenv("BUNDLE_JOBS")
+	if value == "" {
+		return defaultBundleJobs
 	}
-	environmentDefaults := map[string]string{
-		"BUNDLE_PATH": filepath.Join(s.Stager.DepDir(), "vendor_bundle", engine, rubyEngineVersion),
-		"GEM_PATH": strings.Join([]string{
-			filepath.Join(s.Stager.DepDir(), "bundler"),
-			filepath.Join(s.Stager.DepDir(), "vendor_bundle", engine, rubyEngineVersion),
-			filepath.Join(s.Stager.DepDir(), "gem_home"),
-		}, ":"),
+	jobs, err := strconv.Atoi(value)
+	if err != nil || jobs < 1 {
+		s.Log.Warning("BUNDLE_JOBS must be a positive integer, not %s. Using %d jobs.", value, defaultBundleJobs)
+		return defaultBundleJobs
 	}
-	s.Log.Debug("Setting post ruby install env: %v", environmentDefaults)
-	return s.writeEnvFiles(environmentDefaults, true)
+	return jobs
 }
 
-func (s *Supplier) writeEnvFiles(environment map[string]string, clobber bool) error {
-	for envVar, envDefault := range environment {
-		if os.Getenv(envVar) == "" || clobber {
-			_ = os.Setenv(envVar, envDefault)
-			if err := s.Stager.WriteEnvFile(envVar, envDefault); err != nil {
-				return err
-			}
+const defaultBundleRetry = 4
+
+// bundleRetry is how many times bundle install retries failed network
+// requests, from BUNDLE_RETRY.
+func (s *Supplier) bundleRetry() int {
+	retry := defaultBundleRetry
+	if value := os.Getenv("BUNDLE_RETRY"); value != "" {
+		if parsed, err := strconv.Atoi(value); err != nil || parsed < 0 {
+			s.Log.Warning("BUNDLE_RETRY must be a non-negative integer, not %s. Using %d retries.", value, defaultBundleRetry)
+		} else {
+			retry = parsed
 		}
 	}
-	return nil
+	s.Log.Debug("Retrying failed bundler network requests %d times", retry)
+	return retry
 }
 
-func (s *Supplier) WriteProfileD(engine string) error {
-	s.Log.BeginStep("Creating runtime environment")
-
-	rubyEngineVersion, err := s.Versions.RubyEngineVersion()
-	if err != nil {
-		return err
+// useCachedGems reports whether the vendor_bundle restored from the cache
+// was built from this Gemfile.lock and bundle check finds every gem in it
+// there, in which case bundle install can skip fetching from the network.
+func (s *Supplier) useCachedGems(gemfileLockChecksum, appDir string, env []string) (bool, error) {
+	if gemfileLockChecksum == "" || gemfileLockChecksum != s.Cache.Metadata().GemfileLockChecksum {
+		return false, nil
+	}
+	vendorBundle := filepath.Join(s.Stager.DepDir(), "vendor_bundle")
+	if exists, err := libbuildpack.FileExists(vendorBundle); err != nil || !exists {
+		return false, err
 	}
 
-	depsIdx := s.Stager.DepsIdx()
-	scriptContents := fmt.Sprintf(`
-export LANG=${LANG:-en_US.UTF-8}
-export RAILS_ENV=${RAILS_ENV:-production}
-export RACK_ENV=${RACK_ENV:-production}
-export RAILS_SERVE_STATIC_FILES=${RAILS_SERVE_STATIC_FILES:-enabled}
-export RAILS_LOG_TO_STDOUT=${RAILS_LOG_TO_STDOUT:-enabled}
-export BUNDLE_GEMFILE=${BUNDLE_GEMFILE:-$HOME/Gemfile}
-
-export GEM_HOME=${GEM_HOME:-$DEPS_DIR/%s/gem_home}
-export GEM_PATH=${GEM_PATH:-$DEPS_DIR/%s/vendor_bundle/%s/%s:$DEPS_DIR/%s/gem_home:$DEPS_DIR/%s/bundler}
-export BUNDLE_PATH=${BUNDLE_PATH:-$DEPS_DIR/%s/vendor_bundle/%s/%s}
+	output := new(bytes.Buffer)
+	cmd := exec.Command("bundle", "check", "--dry-run", "--path", vendorBundle)
+	cmd.Dir = appDir
+	cmd.Stdout = output
+	cmd.Stderr = output
+	cmd.Env = env
+	if err := s.Command.Run(cmd); err != nil {
+		s.Log.Info("Gemfile.lock is unchanged, but the cached gems are incomplete, so installing gems from the network")
+		s.Log.Debug("bundle check: %s", strings.TrimSpace(output.String()))
+		return false, nil
+	}
 
-## Change to current DEPS_DIR
-bundle config PATH "$DEPS_DIR/%s/vendor_bundle" > /dev/null
-bundle config WITHOUT "%s" > /dev/null
-`, depsIdx, depsIdx, engine, rubyEngineVersion, depsIdx, depsIdx, depsIdx, engine, rubyEngineVersion, depsIdx, os.Getenv("BUNDLE_WITHOUT"))
+	s.Log.Info("Gemfile.lock is unchanged, installing gems from the cache")
+	return true, nil
+}
 
-	if s.appHasGemfile && s.appHasGemfileLock {
-		hasRails41, err := s.Versions.HasGemVersion("rails", ">=4.1.0.beta1")
-		if err != nil {
-			return fmt.Errorf("Could not determine rails version: %v", err)
-		}
-		if hasRails41 {
-			metadata := s.Cache.Metadata()
-			if metadata.SecretKeyBase == "" {
-				metadata.SecretKeyBase, err = s.Command.Output(s.Stager.BuildDir(), "bundle", "exec", "rake", "secret")
-				if err != nil {
-					return fmt.Errorf("Failed to run 'rake secret': %v", err)
-				}
-				metadata.SecretKeyBase = strings.TrimSpace(metadata.SecretKeyBase)
-			}
-			scriptContents += fmt.Sprintf("\nexport SECRET_KEY_BASE=${SECRET_KEY_BASE:-%s}\n", metadata.SecretKeyBase)
-		}
+// fileChecksum returns the md5 of a file, or empty when it does not exist.
+func fileChecksum(file string) (string, error) {
+	f, err := os.Open(file)
+	if os.IsNotExist(err) {
+		return "", nil
+	} else if err != nil {
+		return "", err
 	}
+	defer f.Close()
 
-	return s.Stager.WriteProfileD("ruby.sh", scriptContents)
+	h := md5.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
 }
 
+// checksumIgnoredDirs hold installed dependencies and scratch files rather
+// than the app, so CalcChecksum skips dirs with these names wherever they
+// are. BP_CHECKSUM_IGNORE adds comma separated names to the list.
+var checksumIgnoredDirs = []string{"node_modules", "vendor", "tmp", ".git"}
+
+// CalcChecksum returns an MD5 over the build dir, excluding .cloudfoundry
+// and checksumIgnoredDirs, made of each file's relative path and the MD5 of
+// its contents in path order. Files are hashed by a pool of workers, one per
+// CPU, so the result does not depend on which worker hashes which file.
 func (s *Supplier) CalcChecksum() (string, error) {
-	h := md5.New()
+	ignored := map[string]bool{}
+	for _, name := range append(checksumIgnoredDirs, envPatterns(os.Getenv("BP_CHECKSUM_IGNORE"))...) {
+		ignored[name] = true
+	}
+
 	basepath := s.Stager.BuildDir()
+	var relpaths []string
 	err := filepath.Walk(basepath, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() && path != basepath && ignored[info.Name()] {
+			return filepath.SkipDir
+		}
 		if info.Mode().IsRegular() {
 			relpath, err := filepath.Rel(basepath, path)
-			if strings.HasPrefix(relpath, ".cloudfoundry/") {
-				return nil
-			}
 			if err != nil {
 				return err
 			}
-			if _, err := io.WriteString(h, relpath); err != nil {
-				return err
-			}
-			if f, err := os.Open(path); err != nil {
-				return err
-			} else {
-				if _, err := io.Copy(h, f); err != nil {
-					return err
-				}
+			if !strings.HasPrefix(relpath, ".cloudfoundry/") {
+				relpaths = append(relpaths, relpath)
 			}
 		}
 		return nil
@@ -861,6 +2438,36 @@ func (s *Supplier) CalcChecksum() (string, error) {
 	if err != nil {
 		return "", err
 	}
+	sort.Strings(relpaths)
+
+	digests := make([]string, len(relpaths))
+	errs := make([]error, len(relpaths))
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < runtime.NumCPU(); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				digests[i], errs[i] = fileChecksum(filepath.Join(basepath, relpaths[i]))
+			}
+		}()
+	}
+	for i := range relpaths {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+
+	h := md5.New()
+	for i, relpath := range relpaths {
+		if errs[i] != nil {
+			return "", errs[i]
+		}
+		if _, err := io.WriteString(h, relpath+digests[i]); err != nil {
+			return "", err
+		}
+	}
 	return fmt.Sprintf("%x", h.Sum(nil)), nil
 }
 
@@ -872,16 +2479,246 @@ func (s *Supplier) warnWindowsGemfile() {
 	}
 }
 
+func (s *Supplier) warnProcfileBundle() {
+	if body, err := ioutil.ReadFile(filepath.Join(s.Stager.BuildDir(), "Procfile")); err == nil {
+		if regexp.MustCompile(`(?m)^[^#\n]*\bbundle\b`).Match(body) {
+			s.Log.Warning("Your Procfile runs bundle, but your app does not have a Gemfile, so no gems were installed.\nAdd a Gemfile (and Gemfile.lock) listing your app's gems, or remove bundle from your Procfile.")
+		}
+	}
+}
+
+func (s *Supplier) warnGemfileSource() {
+	if body, err := ioutil.ReadFile(s.Versions.Gemfile()); err == nil {
+		if !regexp.MustCompile(`(?m)^\s*source[\s(]`).Match(body) {
+			s.Log.Warning("Your Gemfile does not declare a source, so bundler will not be able to find any gems.\nAdd the following line to the top of your Gemfile:\n  source \"https://rubygems.org\"")
+		}
+	}
+}
+
 func (s *Supplier) warnBundleConfig() {
 	if exists, err := libbuildpack.FileExists(filepath.Join(s.Stager.BuildDir(), ".bundle", "config")); err == nil && exists {
 		s.Log.Warning("You have the `.bundle/config` file checked into your repository\nIt contains local state like the location of the installed bundle\nas well as configured git local gems, and other settings that should\nnot be shared between multiple checkouts of a single repo. Please\nremove the `.bundle/` folder from your repo and add it to your `.gitignore` file.")
 	}
 }
 
+// readBundleConfig reads the settings in a bundler config file, such as the
+// app's .bundle/config. It is empty when the file does not exist.
+func readBundleConfig(file string) (map[string]string, error) {
+	config := map[string]string{}
+	body, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return config, nil
+	} else if err != nil {
+		return nil, err
+	}
+	for _, line := range strings.Split(strings.Replace(string(body), "\r\n", "\n", -1), "\n") {
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 || !strings.HasPrefix(strings.TrimSpace(parts[0]), "BUNDLE_") {
+			continue
+		}
+		config[strings.TrimSpace(parts[0])] = strings.Trim(strings.TrimSpace(parts[1]), `"'`)
+	}
+	return config, nil
+}
+
+// warnOverriddenBundleConfig warns about settings in the app's .bundle/config
+// that the bundle install flags take precedence over. Bundler applies the
+// rest of .bundle/config, such as BUNDLE_CACHE_ALL and
+// BUNDLE_DISABLE_SHARED_GEMS, as is, and BUNDLE_JOBS and BUNDLE_RETRY are
+// used unless they are also set in the environment. The flags always win for
+// BUNDLE_PATH and BUNDLE_BIN, since gems and binstubs have to be in the dep
+// dir to be in the droplet, and for BUNDLE_DEPLOYMENT, since only apps with a
+// Gemfile.lock are installed in deployment mode.
+func (s *Supplier) warnOverriddenBundleConfig(config, used map[string]string) {
+	var names []string
+	for name := range used {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if value, set := config[name]; set && value != used[name] {
+			s.Log.Warning("Your .bundle/config sets %s to %s, which is ignored: bundle install uses %s", name, value, used[name])
+		}
+	}
+}
+
+// warnRustGems scans the lockfile for RustExtensionGems that will be compiled
+// from source. Gems locked to a precompiled platform (e.g. x86_64-linux) are
+// skipped. BP_STRICT_RUST_GEMS=true turns the warning into a failure.
+func (s *Supplier) warnRustGems(gemfileLock string) error {
+	gems, err := lockedGems(gemfileLock)
+	if err != nil {
+		return nil
+	}
+
+	var found []string
+	for _, name := range RustExtensionGems {
+		for _, version := range gems[name] {
+			if !strings.Contains(version, "-") {
+				found = append(found, name)
+				break
+			}
+		}
+	}
+	if len(found) == 0 {
+		return nil
+	}
+
+	message := fmt.Sprintf("Your Gemfile.lock contains gems with Rust extensions: %s\nThe stack does not provide cargo or rustc, so bundle install will fail to compile them.\nLock a precompiled platform gem (bundle lock --add-platform x86_64-linux) or add a Rust buildpack before this one.", strings.Join(found, ", "))
+	if os.Getenv("BP_STRICT_RUST_GEMS") == "true" {
+		return fmt.Errorf("%s", message)
+	}
+	s.Log.Warning("%s", message)
+	return nil
+}
+
+// warnFreeTDSConflicts warns about FreeTDSConflictingGems locked alongside
+// tiny_tds.
+func (s *Supplier) warnFreeTDSConflicts(gemfileLock string) {
+	gems, err := lockedGems(gemfileLock)
+	if err != nil || gems["tiny_tds"] == nil {
+		return
+	}
+
+	var names []string
+	for name := range FreeTDSConflictingGems {
+		if gems[name] != nil {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		s.Log.Warning("Your Gemfile.lock contains %s alongside tiny_tds.\n%s\nSee https://github.com/rails-sqlserver/tiny_tds#install", name, FreeTDSConflictingGems[name])
+	}
+}
+
+// forceSourceGems reads FORCE_SOURCE_GEMS, a comma separated list of gems
+// whose precompiled platform variants crash against the stack's glibc, and
+// logs which of them will be compiled from source. Bundler only offers
+// force_ruby_platform for the whole bundle outside the Gemfile, so it returns
+// true when bundle install should set BUNDLE_FORCE_RUBY_PLATFORM.
+func (s *Supplier) forceSourceGems(gemfileLock string) (bool, error) {
+	names := envPatterns(os.Getenv("FORCE_SOURCE_GEMS"))
+	if len(names) == 0 {
+		return false, nil
+	}
+
+	gems, err := lockedGems(gemfileLock)
+	if os.IsNotExist(err) {
+		gems = nil
+	} else if err != nil {
+		return false, err
+	}
+
+	for _, name := range names {
+		if _, found := gems[name]; found || gems == nil {
+			s.Log.Info("Compiling %s from source instead of using a precompiled platform gem", name)
+		} else {
+			s.Log.Warning("FORCE_SOURCE_GEMS names %s, which is not in your Gemfile.lock", name)
+		}
+	}
+	s.Log.Info("Setting BUNDLE_FORCE_RUBY_PLATFORM, so every gem with a native extension is compiled from source")
+	return true, nil
+}
+
+// lockfilePlatforms returns the platforms in the PLATFORMS section of a
+// Gemfile.lock.
+func lockfilePlatforms(gemfileLock string) ([]string, error) {
+	body, err := ioutil.ReadFile(gemfileLock)
+	if err != nil {
+		return nil, err
+	}
+
+	var platforms []string
+	inPlatforms := false
+	for _, line := range strings.Split(strings.Replace(string(body), "\r\n", "\n", -1), "\n") {
+		if line == "PLATFORMS" {
+			inPlatforms = true
+		} else if inPlatforms && strings.HasPrefix(line, "  ") {
+			platforms = append(platforms, strings.TrimSpace(line))
+		} else if inPlatforms {
+			break
+		}
+	}
+	return platforms, nil
+}
+
+// stackPlatform is the rubygems platform of the stack's architecture.
+func stackPlatform() string {
+	if nodeArch() == "arm64" {
+		return "aarch64-linux"
+	}
+	return "x86_64-linux"
+}
+
+// checkLockfilePlatforms warns when the Gemfile.lock was resolved only for
+// other platforms, as bundler 2.2+ does on a Mac, since bundler then fails to
+// install platform-specific gems here in confusing ways. Locks that include
+// the ruby platform resolve anywhere, and Windows locks are handled by
+// InstallGems itself.
+func (s *Supplier) checkLockfilePlatforms() {
+	platforms, err := lockfilePlatforms(versions.GemfileLock(s.Versions.Gemfile()))
+	if err != nil || len(platforms) == 0 {
+		return
+	}
+
+	platform := stackPlatform()
+	for _, locked := range platforms {
+		if locked == "ruby" || locked == "java" || locked == platform || strings.HasPrefix(locked, platform+"-") ||
+			strings.Contains(locked, "mingw") || strings.Contains(locked, "mswin") {
+			return
+		}
+	}
+	s.Log.Warning("Your Gemfile.lock is resolved for %s, but not for %s, the platform of this stack.\nBundler may fail to install gems with platform-specific versions. Add the platform and commit the Gemfile.lock:\n  bundle lock --add-platform %s", strings.Join(platforms, ", "), platform, platform)
+}
+
+// lockedGems returns the versions of each gem in the specs of a Gemfile.lock.
+// Platform gems keep their platform suffix, e.g. 1.10.4-x86_64-linux.
+func lockedGems(gemfileLock string) (map[string][]string, error) {
+	body, err := ioutil.ReadFile(gemfileLock)
+	if err != nil {
+		return nil, err
+	}
+
+	gems := map[string][]string{}
+	re := regexp.MustCompile(`(?m)^    (\S+) \(([^)]+)\)$`)
+	for _, match := range re.FindAllStringSubmatch(string(body), -1) {
+		gems[match[1]] = append(gems[match[1]], match[2])
+	}
+	return gems, nil
+}
+
+// bundlerVersion picks the manifest's bundler with the given major version:
+// the one the Gemfile.lock was BUNDLED WITH when the manifest has exactly
+// that version, otherwise the newest.
+func (s *Supplier) bundlerVersion(major string) (string, error) {
+	constraint := major + ".X.X"
+	versions := s.Manifest.AllDependencyVersions("bundler")
+	version, err := libbuildpack.FindMatchingVersion(constraint, versions)
+	if err != nil {
+		return "", fmt.Errorf("failure to install Bundler matching constraint, %s: %s", constraint, err)
+	}
+
+	bundledWith, err := s.bundledWithVersion()
+	if err != nil {
+		return "", err
+	} else if bundledWith == "" || bundledWith == version || !strings.HasPrefix(bundledWith, major+".") {
+		return version, nil
+	}
+	for _, v := range versions {
+		if v == bundledWith {
+			return v, nil
+		}
+	}
+	s.Log.Info("Your Gemfile.lock was BUNDLED WITH bundler %s, which this buildpack does not provide, so bundler %s is used instead", bundledWith, version)
+	return version, nil
+}
+
 func (s *Supplier) installBundlerOne() (string, error) {
-	version, err := libbuildpack.FindMatchingVersion("1.X.X", s.Manifest.AllDependencyVersions("bundler"))
+	version, err := s.bundlerVersion("1")
 	if err != nil {
-		return "", fmt.Errorf("failure to install Bundler matching constraint, 1.X.X: %s", err)
+		return "", err
 	}
 
 	if err := s.Installer.InstallDependency(libbuildpack.Dependency{Name: "bundler", Version: version}, filepath.Join(s.Stager.DepDir(), "bundler")); err != nil {
@@ -895,51 +2732,203 @@ func (s *Supplier) installBundlerOne() (string, error) {
 	return version, nil
 }
 
-func (s *Supplier) installBundlerTwo() (string, error) {
-	version, err := libbuildpack.FindMatchingVersion("2.X.X", s.Manifest.AllDependencyVersions("bundler"))
+// resolveBundlerVersion picks the manifest's newest bundler 2 or later that
+// satisfies the Gemfile.lock's BUNDLED WITH, which allows any newer bundler
+// of the same major, and that runs on the app's ruby. The exact BUNDLED WITH
+// version is preferred. It returns "" when none runs on the app's ruby.
+func (s *Supplier) resolveBundlerVersion() (string, error) {
+	bundledWith, err := s.bundledWithVersion()
+	if err != nil {
+		return "", err
+	}
+
+	requirement := ">= 2.0.0"
+	if locked, err := semver.NewVersion(bundledWith); err == nil && locked.Major() >= 2 {
+		requirement = fmt.Sprintf(">= %s, < %d.0.0", bundledWith, locked.Major()+1)
+	} else {
+		bundledWith = ""
+	}
+	constraint, err := semver.NewConstraint(requirement)
 	if err != nil {
-		return "", fmt.Errorf("failure to install Bundler matching constraint, 2.X.X: %s", err)
+		return "", err
+	}
+
+	var candidates []*semver.Version
+	for _, v := range s.Manifest.AllDependencyVersions("bundler") {
+		if version, err := semver.NewVersion(v); err == nil && constraint.Check(version) {
+			candidates = append(candidates, version)
+		}
+	}
+	if len(candidates) == 0 {
+		return "", fmt.Errorf("failure to install Bundler matching constraint, %s: no match found", requirement)
+	}
+	sort.Sort(sort.Reverse(semver.Collection(candidates)))
+	for i, candidate := range candidates {
+		if candidate.Original() == bundledWith {
+			copy(candidates[1:i+1], candidates[:i])
+			candidates[0] = candidate
+			break
+		}
+	}
+
+	for _, candidate := range candidates {
+		if ok, err := s.Versions.CheckBundlerCompatibility(candidate.Original()); err != nil {
+			return "", err
+		} else if ok {
+			if bundledWith != "" && candidates[0].Original() != bundledWith {
+				s.Log.Info("Your Gemfile.lock was BUNDLED WITH bundler %s, which this buildpack does not provide, so bundler %s is used instead", bundledWith, candidate.Original())
+			}
+			return candidate.Original(), nil
+		}
+		s.Log.Debug("Ruby version not compatible with bundler %s", candidate.Original())
 	}
+	return "", nil
+}
 
+func (s *Supplier) installBundlerTwo(version string) error {
 	installDir := filepath.Join(s.Stager.DepDir(), "bundler2")
 
 	if err := s.Installer.InstallDependency(libbuildpack.Dependency{Name: "bundler", Version: version}, installDir); err != nil {
-		return "", err
+		return err
 	}
 	defer os.RemoveAll(installDir)
 
+	return s.copyBundlerGem(installDir, version)
+}
+
+// copyBundlerGem copies the bundler gem and gemspec found in gemDir into
+// <depdir>/bundler alongside the bundler installed by installBundlerOne.
+func (s *Supplier) copyBundlerGem(gemDir, version string) error {
 	gemName := fmt.Sprintf("bundler-%s", version)
 
 	destDir := filepath.Join(s.Stager.DepDir(), "bundler", "gems", gemName)
 	if err := os.MkdirAll(destDir, 0777); err != nil {
-		return "", err
+		return err
 	}
 
-	if err := libbuildpack.CopyDirectory(filepath.Join(installDir, "gems", gemName), destDir); err != nil {
-		return "", err
+	if err := libbuildpack.CopyDirectory(filepath.Join(gemDir, "gems", gemName), destDir); err != nil {
+		return err
 	}
 
-	if err := libbuildpack.CopyFile(filepath.Join(installDir, "specifications", gemName+".gemspec"), filepath.Join(s.Stager.DepDir(), "bundler", "specifications", gemName+".gemspec")); err != nil {
-		return "", err
+	return libbuildpack.CopyFile(filepath.Join(gemDir, "specifications", gemName+".gemspec"), filepath.Join(s.Stager.DepDir(), "bundler", "specifications", gemName+".gemspec"))
+}
+
+// installVendoredBundler uses a bundler committed to vendor/bundler (laid
+// out as gems/bundler-X and specifications/bundler-X.gemspec) instead of
+// the manifest's bundler 2. It returns false when no usable bundler is found.
+func (s *Supplier) installVendoredBundler(bundlerOneVersion string) (bool, error) {
+	vendorDir := filepath.Join(s.Stager.BuildDir(), "vendor", "bundler")
+	paths, err := filepath.Glob(filepath.Join(vendorDir, "gems", "bundler-*"))
+	if err != nil {
+		return false, err
+	} else if len(paths) == 0 {
+		return false, nil
+	} else if len(paths) > 1 {
+		s.Log.Warning("Found multiple bundlers in vendor/bundler, ignoring them")
+		return false, nil
 	}
 
-	return version, nil
+	version := strings.TrimPrefix(filepath.Base(paths[0]), "bundler-")
+	if exists, err := libbuildpack.FileExists(filepath.Join(vendorDir, "specifications", fmt.Sprintf("bundler-%s.gemspec", version))); err != nil {
+		return false, err
+	} else if !exists {
+		s.Log.Warning("Found vendored bundler %s without a gemspec, ignoring it", version)
+		return false, nil
+	}
+
+	if bundledWith, err := s.bundledWithVersion(); err != nil {
+		return false, err
+	} else if bundledWith != "" && bundledWith != version {
+		s.Log.Warning("Vendored bundler %s does not match the version your Gemfile.lock was BUNDLED WITH (%s)", version, bundledWith)
+	}
+
+	if version == bundlerOneVersion {
+		s.Log.Info("Using vendored bundler %s", version)
+		return true, nil
+	}
+
+	if err := s.copyBundlerGem(vendorDir, version); err != nil {
+		return false, err
+	}
+	s.Versions.SetBundlerVersion(version)
+
+	if !strings.HasPrefix(version, "1.") {
+		if ok, err := s.Versions.CheckBundlerCompatibility(version); err != nil {
+			return false, err
+		} else if !ok {
+			s.Log.Warning("Ruby version not compatible with vendored bundler %s", version)
+			s.Versions.SetBundlerVersion(bundlerOneVersion)
+			return false, s.removeBundlerGem(version)
+		}
+	}
+
+	s.Log.Info("Using vendored bundler %s", version)
+	return true, nil
 }
 
-func (s *Supplier) uninstallBundlerTwo() error {
-	version, err := libbuildpack.FindMatchingVersion("2.X.X", s.Manifest.AllDependencyVersions("bundler"))
+// bundledWithVersion returns the version under BUNDLED WITH in the app's
+// Gemfile.lock, or "" if there is no lockfile or it has no such section.
+func (s *Supplier) bundledWithVersion() (string, error) {
+	body, err := ioutil.ReadFile(versions.GemfileLock(s.Versions.Gemfile()))
 	if err != nil {
-		return fmt.Errorf("failure to install Bundler matching constraint, 2.X.X: %s", err)
+		if os.IsNotExist(err) {
+			return "", nil
+		}
+		return "", err
 	}
 
-	gemName := fmt.Sprintf("bundler-%s", version)
+	lines := strings.Split(strings.Replace(string(body), "\r\n", "\n", -1), "\n")
+	for i, line := range lines {
+		if strings.TrimSpace(line) == "BUNDLED WITH" && i+1 < len(lines) {
+			return strings.TrimSpace(lines[i+1]), nil
+		}
+	}
+	return "", nil
+}
 
-	if err := os.RemoveAll(filepath.Join(s.Stager.DepDir(), "bundler", "gems", gemName)); err != nil {
+// checkBundledWithAvailable fails when the Gemfile.lock was BUNDLED WITH a
+// bundler newer than any in the manifest, which otherwise fails later with
+// a confusing error from bundle install.
+func (s *Supplier) checkBundledWithAvailable() error {
+	bundledWith, err := s.bundledWithVersion()
+	if err != nil || bundledWith == "" {
 		return err
 	}
 
-	if err := os.RemoveAll(filepath.Join(s.Stager.DepDir(), "bundler", "specifications", gemName+".gemspec")); err != nil {
-		return err
+	versions := s.Manifest.AllDependencyVersions("bundler")
+	if _, err := libbuildpack.FindMatchingVersion(">= "+bundledWith, versions); err != nil {
+		return fmt.Errorf("Your Gemfile.lock was BUNDLED WITH bundler %s, but the newest bundler this buildpack provides is %s.\nRelax BUNDLED WITH in your Gemfile.lock (e.g. regenerate it with bundler %s), or wait for a buildpack release with a newer bundler.", bundledWith, newestVersion(versions), newestVersion(versions))
+	}
+	return nil
+}
+
+func newestVersion(versions []string) string {
+	newest, err := libbuildpack.FindMatchingVersion("x", versions)
+	if err != nil {
+		return "none"
+	}
+	return newest
+}
+
+// uninstallBundlerOne removes the bundler 1 gem once bundler 2 has been
+// selected. The bundler/bin executables are left alone since they resolve
+// whichever bundler gem remains in bundler/gems.
+func (s *Supplier) uninstallBundlerOne(version string) error {
+	return s.removeBundlerGem(version)
+}
+
+func (s *Supplier) removeBundlerGem(version string) error {
+	gemName := fmt.Sprintf("bundler-%s", version)
+
+	for _, path := range []string{
+		filepath.Join(s.Stager.DepDir(), "bundler", "gems", gemName),
+		filepath.Join(s.Stager.DepDir(), "bundler", "specifications", gemName+".gemspec"),
+		filepath.Join(s.Stager.DepDir(), "bundler", "cache", gemName+".gem"),
+		filepath.Join(s.Stager.DepDir(), "bundler", "doc", gemName),
+	} {
+		if err := os.RemoveAll(path); err != nil {
+			return err
+		}
 	}
 
 	return nil
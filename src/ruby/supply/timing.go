@@ -0,0 +1,55 @@
+package supply
+
+import (
+	"time"
+)
+
+// StepTimer records how long each step of staging takes, so the slow one can
+// be found without reading timestamps off the log. Starting a step ends the
+// one before it, and the total is timed from the first step.
+type StepTimer struct {
+	Now func() time.Time
+
+	start   time.Time
+	current string
+	begun   time.Time
+	names   []string
+	elapsed map[string]time.Duration
+}
+
+func NewStepTimer() *StepTimer {
+	return &StepTimer{Now: time.Now, elapsed: map[string]time.Duration{}}
+}
+
+// Start ends the current step, if any, and starts timing name. Starting a
+// step again adds to its earlier time.
+func (t *StepTimer) Start(name string) {
+	t.end()
+	if _, seen := t.elapsed[name]; !seen {
+		t.names = append(t.names, name)
+		t.elapsed[name] = 0
+	}
+	t.current = name
+	t.begun = t.Now()
+	if t.start.IsZero() {
+		t.start = t.begun
+	}
+}
+
+func (t *StepTimer) end() {
+	if t.current == "" {
+		return
+	}
+	t.elapsed[t.current] += t.Now().Sub(t.begun)
+	t.current = ""
+}
+
+// Report ends the current step and logs the time taken by each step at
+// Debug, then the total at Info.
+func (t *StepTimer) Report(log Logger) {
+	t.end()
+	for _, name := range t.names {
+		log.Debug("%-14s %s", name, t.elapsed[name].Round(time.Millisecond))
+	}
+	log.Info("Supplied in %s", t.Now().Sub(t.start).Round(time.Millisecond))
+}
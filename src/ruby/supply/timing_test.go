@@ -0,0 +1,65 @@
+package supply_test
+
+import (
+	"bytes"
+	"os"
+	"time"
+
+	"github.com/cloudfoundry/ruby-buildpack/src/ruby/supply"
+
+	"github.com/cloudfoundry/libbuildpack"
+	"github.com/cloudfoundry/libbuildpack/ansicleaner"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("StepTimer", func() {
+	var (
+		buffer *bytes.Buffer
+		logger *libbuildpack.Logger
+		now    time.Time
+		timer  *supply.StepTimer
+	)
+
+	tick := func(d time.Duration) { now = now.Add(d) }
+
+	BeforeEach(func() {
+		buffer = new(bytes.Buffer)
+		logger = libbuildpack.NewLogger(ansicleaner.New(buffer))
+
+		now = time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+		timer = supply.NewStepTimer()
+		timer.Now = func() time.Time { return now }
+	})
+
+	AfterEach(func() {
+		os.Unsetenv("BP_DEBUG")
+	})
+
+	It("logs the total time at Info", func() {
+		timer.Start("FreeTDS")
+		tick(3 * time.Second)
+		timer.Start("Ruby")
+		tick(1500 * time.Millisecond)
+		timer.Report(logger)
+
+		Expect(buffer.String()).To(ContainSubstring("Supplied in 4.5s"))
+		Expect(buffer.String()).ToNot(ContainSubstring("FreeTDS"))
+	})
+
+	It("logs the time of each step, in the order they started, at Debug", func() {
+		os.Setenv("BP_DEBUG", "true")
+		timer.Start("FreeTDS")
+		tick(3 * time.Second)
+		timer.Start("Ruby")
+		tick(time.Minute)
+		timer.Start("Gems")
+		tick(20 * time.Second)
+		timer.Start("Ruby")
+		tick(2 * time.Second)
+		timer.Report(logger)
+
+		Expect(buffer.String()).To(MatchRegexp(`FreeTDS +3s\n.*Ruby +1m2s\n.*Gems +20s\n`))
+		Expect(buffer.String()).To(ContainSubstring("Supplied in 1m25s"))
+	})
+})
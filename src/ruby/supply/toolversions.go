@@ -0,0 +1,37 @@
+package supply
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const ToolVersionsFile = ".tool-versions"
+
+// toolVersion returns the version asdf's .tool-versions pins for tool, or
+// empty when there is no such file or it has no line for tool. Comments and
+// the lines of other tools are ignored, and when a line lists several
+// versions the first is the one asdf uses. asdf's system version, which
+// defers to whatever is installed, counts as no version.
+func (s *Supplier) toolVersion(tool string) (string, error) {
+	body, err := ioutil.ReadFile(filepath.Join(s.Stager.BuildDir(), ToolVersionsFile))
+	if os.IsNotExist(err) {
+		return "", nil
+	} else if err != nil {
+		return "", err
+	}
+
+	for _, line := range strings.Split(string(body), "\n") {
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		if fields := strings.Fields(line); len(fields) >= 2 && fields[0] == tool {
+			if fields[1] == "system" {
+				return "", nil
+			}
+			return fields[1], nil
+		}
+	}
+	return "", nil
+}
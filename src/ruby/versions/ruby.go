@@ -2,6 +2,7 @@ package versions
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/Masterminds/semver"
 	"io/ioutil"
@@ -14,6 +15,13 @@ import (
 	"github.com/cloudfoundry/libbuildpack"
 )
 
+// GemsRb is bundler's alternative name for a Gemfile, locked in gems.locked.
+const GemsRb = "gems.rb"
+
+// ErrUnavailableRuby is wrapped by errors for a ruby version the app asks
+// for that no ruby in the manifest matches.
+var ErrUnavailableRuby = errors.New("does not match an available ruby version")
+
 type Manifest interface {
 	AllDependencyVersions(string) []string
 	DefaultVersion(string) (libbuildpack.Dependency, error)
@@ -54,13 +62,44 @@ func (v *Versions) GetBundlerVersion() string {
 	return v.bundlerVersion
 }
 
+// bundlerRubyMinimums are the oldest rubies each bundler line runs on,
+// newest line first.
+var bundlerRubyMinimums = []struct{ bundler, ruby string }{
+	{"2.6.0", "3.1.0"},
+	{"2.5.0", "3.0.0"},
+	{"2.4.0", "2.6.0"},
+	{"2.0.0", "2.3.0"},
+}
+
 func (v *Versions) CheckBundler2Compatibility() (bool, error) {
+	return v.CheckBundlerCompatibility("2.0.0")
+}
+
+// CheckBundlerCompatibility reports whether the app's ruby, from the Gemfile
+// or else the manifest default, is new enough for bundlerVersion. Only MRI
+// is checked, since jruby and truffleruby versions are not MRI versions.
+func (v *Versions) CheckBundlerCompatibility(bundlerVersion string) (bool, error) {
+	bundlerSemver, err := semver.NewVersion(bundlerVersion)
+	if err != nil {
+		return false, err
+	}
+	minimumRuby := ""
+	for _, minimum := range bundlerRubyMinimums {
+		if !bundlerSemver.LessThan(semver.MustParse(minimum.bundler)) {
+			minimumRuby = minimum.ruby
+			break
+		}
+	}
+	if minimumRuby == "" {
+		return true, nil
+	}
+
 	engine, err := v.Engine()
 	if err != nil {
 		return false, err
 	}
 
-	if engine == "jruby" {
+	if engine != "ruby" {
 		return true, nil
 	}
 
@@ -77,30 +116,21 @@ func (v *Versions) CheckBundler2Compatibility() (bool, error) {
 		gemfileRubyVersion = dep.Version
 	}
 
-	rubyConstraint, err := semver.NewConstraint("<= 2.2.X")
-	if err != nil {
-		return false, err
-	}
-
 	rubySemver, err := semver.NewVersion(gemfileRubyVersion)
 	if err != nil {
 		return false, err
 	}
 
-	if engine == "ruby" && rubyConstraint.Check(rubySemver) {
-		return false, nil
-	}
-
-	return true, nil
+	return !rubySemver.LessThan(semver.MustParse(minimumRuby)), nil
 }
 
 func (v *Versions) Engine() (string, error) {
 	gemfile := v.Gemfile()
 	code := fmt.Sprintf(`
-		b = Bundler::Dsl.evaluate('%s', '%s.lock', {}).ruby_version if File.exists?('%s')
+		b = Bundler::Dsl.evaluate('%s', '%s', {}).ruby_version if File.exists?('%s')
 	  return 'ruby' if !b
 		b.engine
-	`, filepath.Base(gemfile), filepath.Base(gemfile), filepath.Base(gemfile))
+	`, filepath.Base(gemfile), filepath.Base(GemfileLock(gemfile)), filepath.Base(gemfile))
 
 	data, err := v.run(filepath.Dir(gemfile), code, []string{})
 	if err != nil {
@@ -114,31 +144,43 @@ func (v *Versions) Version() (string, error) {
 	versions := v.manifest.AllDependencyVersions("ruby")
 	gemfile := v.Gemfile()
 	code := fmt.Sprintf(`
-		b = Bundler::Dsl.evaluate('%s', '%s.lock', {}).ruby_version
+		b = Bundler::Dsl.evaluate('%s', '%s', {}).ruby_version
 	  return '' if !b
 
 		r = Gem::Requirement.create(b.versions)
 		version = input.select { |v| r.satisfied_by? Gem::Version.new(v) }.sort.last
-		raise "No Matching versions, ruby #{r} not found in this buildpack" unless version
-		version
-	`, filepath.Base(gemfile), filepath.Base(gemfile))
+		version || { 'unmatched' => r.to_s }
+	`, filepath.Base(gemfile), filepath.Base(GemfileLock(gemfile)))
 
 	data, err := v.run(filepath.Dir(gemfile), code, versions)
 	if err != nil {
 		return "", err
 	}
 
+	if unmatched, ok := data.(map[string]interface{}); ok {
+		return "", fmt.Errorf("%s asks for ruby %v, which %w", filepath.Base(gemfile), unmatched["unmatched"], ErrUnavailableRuby)
+	}
 	return data.(string), nil
 }
 
 func (v *Versions) JrubyVersion() (string, error) {
+	return v.engineVersion()
+}
+
+func (v *Versions) TruffleRubyVersion() (string, error) {
+	return v.engineVersion()
+}
+
+// engineVersion returns the :engine_version the Gemfile's ruby directive
+// asks for, which is how jruby and truffleruby versions are chosen.
+func (v *Versions) engineVersion() (string, error) {
 	gemfile := v.Gemfile()
 	code := fmt.Sprintf(`
-		b = Bundler::Dsl.evaluate('%s', '%s.lock', {}).ruby_version
+		b = Bundler::Dsl.evaluate('%s', '%s', {}).ruby_version
 	  return '' if !b
 
 	  "#{b.versions_string(b.engine_versions)}"
-	`, filepath.Base(gemfile), filepath.Base(gemfile))
+	`, filepath.Base(gemfile), filepath.Base(GemfileLock(gemfile)))
 
 	data, err := v.run(filepath.Dir(gemfile), code, []string{})
 	if err != nil {
@@ -223,7 +265,7 @@ func (v *Versions) GemMajorVersion(gem string) (int, error) {
 //     -or-
 // (2) the Gemfile.lock line endings are /r/n, rather than just /n
 func (v *Versions) HasWindowsGemfileLock() (bool, error) {
-	gemfileLockPath := v.Gemfile() + ".lock"
+	gemfileLockPath := GemfileLock(v.Gemfile())
 	if good, err := libbuildpack.FileExists(gemfileLockPath); err != nil {
 		return false, err
 	} else if !good {
@@ -249,7 +291,7 @@ func (v *Versions) HasWindowsGemfileLock() (bool, error) {
 
 	data, err := v.run(filepath.Dir(v.Gemfile()),
 		code,
-		map[string]string{"gemfilelock": fmt.Sprintf("%s.lock", v.Gemfile())})
+		map[string]string{"gemfilelock": GemfileLock(v.Gemfile())})
 	if err != nil {
 		return false, err
 	}
@@ -265,7 +307,7 @@ func (v *Versions) specs() (map[string]string, error) {
 		Hash[*(parsed.specs.map{|spec| [spec.name, spec.version.to_s]}).flatten]
 	`
 
-	data, err := v.run(filepath.Dir(v.Gemfile()), code, map[string]string{"gemfilelock": fmt.Sprintf("%s.lock", v.Gemfile())})
+	data, err := v.run(filepath.Dir(v.Gemfile()), code, map[string]string{"gemfilelock": GemfileLock(v.Gemfile())})
 	if err != nil {
 		return nil, err
 	}
@@ -277,14 +319,33 @@ func (v *Versions) specs() (map[string]string, error) {
 	return v.cachedSpecs, nil
 }
 
+// Gemfile returns the path of the app's Gemfile, from BUNDLE_GEMFILE when it
+// is set. A relative BUNDLE_GEMFILE is relative to the build dir. Otherwise
+// it is the Gemfile in the build dir, or gems.rb when the app only has that.
 func (v *Versions) Gemfile() string {
 	gemfile := "Gemfile"
 	if os.Getenv("BUNDLE_GEMFILE") != "" {
 		gemfile = os.Getenv("BUNDLE_GEMFILE")
+	} else if hasGemsRb, _ := libbuildpack.FileExists(filepath.Join(v.buildDir, GemsRb)); hasGemsRb {
+		if hasGemfile, _ := libbuildpack.FileExists(filepath.Join(v.buildDir, "Gemfile")); !hasGemfile {
+			gemfile = GemsRb
+		}
+	}
+	if filepath.IsAbs(gemfile) {
+		return gemfile
 	}
 	return filepath.Join(v.buildDir, gemfile)
 }
 
+// GemfileLock returns the lockfile bundler uses for gemfile: gems.locked
+// next to a gems.rb, else the gemfile's path with .lock appended.
+func GemfileLock(gemfile string) string {
+	if filepath.Base(gemfile) == GemsRb {
+		return filepath.Join(filepath.Dir(gemfile), "gems.locked")
+	}
+	return gemfile + ".lock"
+}
+
 func (v *Versions) run(dir, code string, in interface{}) (interface{}, error) {
 	data, err := json.Marshal(in)
 	if err != nil {
@@ -1,6 +1,7 @@
 package versions_test
 
 import (
+	"errors"
 	"io/ioutil"
 	"os"
 	"path/filepath"
@@ -115,6 +116,41 @@ var _ = Describe("Ruby", func() {
 		})
 	})
 
+	Describe("CheckBundlerCompatibility", func() {
+		It("accepts bundler 1 on any ruby", func() {
+			v := versions.New(tmpDir, depDir, mockManifest)
+			Expect(v.CheckBundlerCompatibility("1.17.3")).To(BeTrue())
+		})
+
+		Context("Gemfile asks for ruby 2.5", func() {
+			BeforeEach(func() {
+				Expect(ioutil.WriteFile(filepath.Join(tmpDir, "Gemfile"), []byte(`ruby "~>2.5.0"`), 0644)).To(Succeed())
+				mockManifest.EXPECT().AllDependencyVersions("ruby").Return([]string{"2.5.8", "2.6.6"}).AnyTimes()
+			})
+
+			It("accepts bundler 2.3", func() {
+				v := versions.New(tmpDir, depDir, mockManifest)
+				Expect(v.CheckBundlerCompatibility("2.3.26")).To(BeTrue())
+			})
+
+			It("rejects bundler 2.4, which needs ruby 2.6", func() {
+				v := versions.New(tmpDir, depDir, mockManifest)
+				Expect(v.CheckBundlerCompatibility("2.4.10")).To(BeFalse())
+			})
+		})
+
+		Context("Gemfile has jruby", func() {
+			BeforeEach(func() {
+				Expect(ioutil.WriteFile(filepath.Join(tmpDir, "Gemfile"), []byte(`ruby '2.5.7', :engine => 'jruby', :engine_version => '9.2.13.0'`), 0644)).To(Succeed())
+			})
+
+			It("accepts any bundler", func() {
+				v := versions.New(tmpDir, depDir, mockManifest)
+				Expect(v.CheckBundlerCompatibility("2.5.3")).To(BeTrue())
+			})
+		})
+	})
+
 	Describe("Engine", func() {
 		Context("Gemfile has a mri", func() {
 			BeforeEach(func() {
@@ -183,7 +219,8 @@ var _ = Describe("Ruby", func() {
 				mockManifest.EXPECT().AllDependencyVersions("ruby").Return([]string{"1.2.3", "3.1.2"})
 				v := versions.New(tmpDir, depDir, mockManifest)
 				_, err := v.Version()
-				Expect(err).To(MatchError("Running ruby: No Matching versions, ruby ~> 2.2.0 not found in this buildpack"))
+				Expect(err).To(MatchError("Gemfile asks for ruby ~> 2.2.0, which does not match an available ruby version"))
+				Expect(errors.Is(err, versions.ErrUnavailableRuby)).To(BeTrue())
 			})
 		})
 
@@ -219,7 +256,8 @@ var _ = Describe("Ruby", func() {
 				mockManifest.EXPECT().AllDependencyVersions("ruby").Return([]string{"1.2.3", "2.2.0", "3.1.2"})
 				v := versions.New(tmpDir, depDir, mockManifest)
 				_, err := v.Version()
-				Expect(err).To(MatchError("Running ruby: No Matching versions, ruby ~> 2.3.0 not found in this buildpack"))
+				Expect(err).To(MatchError("Gemfile-App asks for ruby ~> 2.3.0, which does not match an available ruby version"))
+				Expect(errors.Is(err, versions.ErrUnavailableRuby)).To(BeTrue())
 			})
 		})
 	})
@@ -249,6 +287,60 @@ var _ = Describe("Ruby", func() {
 		})
 	})
 
+	Describe("TruffleRubyVersion", func() {
+		BeforeEach(func() {
+			Expect(ioutil.WriteFile(filepath.Join(tmpDir, "Gemfile"), []byte(`ruby '2.6.2', :engine => 'truffleruby', :engine_version => '20.1.0'`), 0644)).To(Succeed())
+		})
+		It("returns the requested version", func() {
+			v := versions.New(tmpDir, depDir, mockManifest)
+			Expect(v.TruffleRubyVersion()).To(Equal("20.1.0"))
+		})
+	})
+
+	Describe("Gemfile", func() {
+		AfterEach(func() { os.Unsetenv("BUNDLE_GEMFILE") })
+
+		It("defaults to the Gemfile in the build dir", func() {
+			v := versions.New(tmpDir, depDir, mockManifest)
+			Expect(v.Gemfile()).To(Equal(filepath.Join(tmpDir, "Gemfile")))
+		})
+
+		It("resolves a relative BUNDLE_GEMFILE against the build dir", func() {
+			os.Setenv("BUNDLE_GEMFILE", "gemfiles/production.gemfile")
+			v := versions.New(tmpDir, depDir, mockManifest)
+			Expect(v.Gemfile()).To(Equal(filepath.Join(tmpDir, "gemfiles", "production.gemfile")))
+		})
+
+		It("uses gems.rb when the app has no Gemfile", func() {
+			Expect(ioutil.WriteFile(filepath.Join(tmpDir, "gems.rb"), []byte{}, 0644)).To(Succeed())
+			v := versions.New(tmpDir, depDir, mockManifest)
+			Expect(v.Gemfile()).To(Equal(filepath.Join(tmpDir, "gems.rb")))
+		})
+
+		It("prefers the Gemfile when the app has both", func() {
+			Expect(ioutil.WriteFile(filepath.Join(tmpDir, "Gemfile"), []byte{}, 0644)).To(Succeed())
+			Expect(ioutil.WriteFile(filepath.Join(tmpDir, "gems.rb"), []byte{}, 0644)).To(Succeed())
+			v := versions.New(tmpDir, depDir, mockManifest)
+			Expect(v.Gemfile()).To(Equal(filepath.Join(tmpDir, "Gemfile")))
+		})
+
+		It("returns an absolute BUNDLE_GEMFILE as is", func() {
+			os.Setenv("BUNDLE_GEMFILE", filepath.Join(tmpDir, "gemfiles", "production.gemfile"))
+			v := versions.New(tmpDir, depDir, mockManifest)
+			Expect(v.Gemfile()).To(Equal(filepath.Join(tmpDir, "gemfiles", "production.gemfile")))
+		})
+	})
+
+	Describe("GemfileLock", func() {
+		It("appends .lock to a Gemfile", func() {
+			Expect(versions.GemfileLock("/app/gemfiles/production.gemfile")).To(Equal("/app/gemfiles/production.gemfile.lock"))
+		})
+
+		It("uses gems.locked for gems.rb", func() {
+			Expect(versions.GemfileLock("/app/gems.rb")).To(Equal("/app/gems.locked"))
+		})
+	})
+
 	Describe("RubyEngineVersion", func() {
 		It("returns the gem simplified ruby version", func() {
 			v := versions.New(tmpDir, depDir, mockManifest)